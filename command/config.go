@@ -0,0 +1,439 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pbergman/graylog-proxy/net"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// listenConfig holds the settings of the listen command. The settings of
+// every listener and output are a flag set so the same helpers are used as
+// for the command line flags, the flags given on the command line override
+// the values of the config file.
+type listenConfig struct {
+	flags     *pflag.FlagSet
+	listeners []*configEntry
+	outputs   []*configEntry
+	routes    []*configRoute
+}
+
+// configEntry is a listener or output with its own flag set
+type configEntry struct {
+	name    string
+	address string
+	line    int
+	flags   *pflag.FlagSet
+}
+
+// configRoute sends the messages matching the filter to the named outputs
+type configRoute struct {
+	line    int
+	filter  *net.TailFilter
+	outputs []string
+}
+
+// configError is an error with the location in the config file
+type configError struct {
+	file    string
+	line    int
+	message string
+}
+
+func (c *configError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", c.file, c.line, c.message)
+}
+
+// addListenerFlags will add the flags that can be set for every listener
+func addListenerFlags(set *pflag.FlagSet) {
+	set.Bool("inject-id", false, "")
+	set.Lookup("inject-id").NoOptDefVal = "true"
+	set.StringSlice("allow", nil, "")
+	set.StringSlice("deny", nil, "")
+	set.UintSlice("allow-uid", nil, "")
+	set.UintSlice("allow-gid", nil, "")
+	set.String("rate-limit-key", "source", "")
+	set.Float64("rate-limit-messages", 0, "")
+	set.Int("rate-limit-message-burst", 0, "")
+	set.String("rate-limit-bytes", "0", "")
+	set.String("rate-limit-byte-burst", "0", "")
+	set.Bool("rate-limit-report", false, "")
+	set.Lookup("rate-limit-report").NoOptDefVal = "true"
+}
+
+// addOutputFlags will add the flags that can be set for every output
+func addOutputFlags(set *pflag.FlagSet) {
+	set.Bool("new-line", false, "")
+	set.Lookup("new-line").NoOptDefVal = "true"
+	set.IntP("workers", "w", 10, "")
+	addRemoteFlags(set)
+}
+
+// newListenFlagSet creates a flag set with all flags of the listen command
+func newListenFlagSet(container *Container) *pflag.FlagSet {
+	set := pflag.NewFlagSet("listen", pflag.ContinueOnError)
+	container.AddFlags(set)
+	addListenFlags(set)
+	addListenerFlags(set)
+	addOutputFlags(set)
+	return set
+}
+
+// flagNames returns the names of the flags added by the given function
+func flagNames(add func(*pflag.FlagSet)) map[string]bool {
+	set, names := pflag.NewFlagSet("", pflag.ContinueOnError), make(map[string]bool)
+	add(set)
+	set.VisitAll(func(flag *pflag.Flag) {
+		names[flag.Name] = true
+	})
+	return names
+}
+
+// sortedNames returns the names of the given set sorted for error messages
+func sortedNames(names map[string]bool, extra ...string) string {
+	list := append([]string{}, extra...)
+	for name := range names {
+		list = append(list, name)
+	}
+	sort.Strings(list[len(extra):])
+	return strings.Join(list, ", ")
+}
+
+// setFlag will set the flag to the (list of) values of the given node,
+// lists replace the current value so a listener or output can overwrite
+// the value that is set on the top level
+func setFlag(set *pflag.FlagSet, name string, node *yaml.Node) error {
+	flag := set.Lookup(name)
+	slice, isSlice := flag.Value.(pflag.SliceValue)
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if isSlice {
+			return slice.Replace([]string{node.Value})
+		}
+		return flag.Value.Set(node.Value)
+	case yaml.SequenceNode:
+		if !isSlice {
+			return errors.New("expected a single value not a list")
+		}
+		values := make([]string, len(node.Content))
+		for i, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return errors.New("expected a list of values")
+			}
+			values[i] = item.Value
+		}
+		return slice.Replace(values)
+	default:
+		return errors.New("expected a value or a list of values")
+	}
+}
+
+// overrideFlags will copy the flags that are set on the command line
+func overrideFlags(set *pflag.FlagSet, cli *pflag.FlagSet) (err error) {
+	cli.Visit(func(flag *pflag.Flag) {
+		target := set.Lookup(flag.Name)
+		if target == nil || err != nil {
+			return
+		}
+		if slice, ok := flag.Value.(pflag.SliceValue); ok {
+			err = target.Value.(pflag.SliceValue).Replace(slice.GetSlice())
+		} else {
+			err = target.Value.Set(flag.Value.String())
+		}
+	})
+	return
+}
+
+// configLoader reads the config file, it keeps the top level values
+// because these are the defaults for the listeners and outputs
+type configLoader struct {
+	file      string
+	cli       *pflag.FlagSet
+	container *Container
+	defaults  []*yaml.Node
+}
+
+func (l *configLoader) error(node *yaml.Node, format string, args ...interface{}) error {
+	return &configError{file: l.file, line: node.Line, message: fmt.Sprintf(format, args...)}
+}
+
+// mapping returns the key and value nodes of a mapping node
+func (l *configLoader) mapping(node *yaml.Node, what string) ([]*yaml.Node, error) {
+	if node.Kind != yaml.MappingNode {
+		return nil, l.error(node, "expected %s to be a mapping", what)
+	}
+	return node.Content, nil
+}
+
+// sequence returns the items of a sequence node
+func (l *configLoader) sequence(node *yaml.Node, what string) ([]*yaml.Node, error) {
+	if node.Kind != yaml.SequenceNode {
+		return nil, l.error(node, "expected %s to be a list", what)
+	}
+	return node.Content, nil
+}
+
+// flags creates the flag set for the given values, the top
+// level values and command line flags are applied as well
+func (l *configLoader) flags(values []*yaml.Node) (*pflag.FlagSet, error) {
+	set := newListenFlagSet(l.container)
+	for _, nodes := range [][]*yaml.Node{l.defaults, values} {
+		for i := 0; i < len(nodes); i += 2 {
+			if err := setFlag(set, nodes[i].Value, nodes[i+1]); err != nil {
+				return nil, l.error(nodes[i+1], "invalid value for '%s': %s", nodes[i].Value, err.Error())
+			}
+		}
+	}
+	if err := overrideFlags(set, l.cli); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// entry reads a listener or output, the address is required and
+// the other keys should be one of the given flag names
+func (l *configLoader) entry(node *yaml.Node, what string, names map[string]bool, fields ...string) (*configEntry, map[string]string, error) {
+	content, err := l.mapping(node, "a "+what)
+	if err != nil {
+		return nil, nil, err
+	}
+	var entry = &configEntry{line: node.Line}
+	var values []*yaml.Node
+	var extra = make(map[string]string)
+	for i := 0; i < len(content); i += 2 {
+		key, value := content[i], content[i+1]
+		switch {
+		case key.Value == "address" || inList(key.Value, fields):
+			if value.Kind != yaml.ScalarNode || value.Value == "" {
+				return nil, nil, l.error(value, "expected a value for the %s %s", what, key.Value)
+			}
+			extra[key.Value] = value.Value
+		case names[key.Value]:
+			values = append(values, key, value)
+		default:
+			return nil, nil, l.error(key, "unknown option '%s' for a %s, expected %s", key.Value, what, sortedNames(names, append([]string{"address"}, fields...)...))
+		}
+	}
+	if entry.address = extra["address"]; entry.address == "" {
+		return nil, nil, l.error(node, "missing the address of the %s", what)
+	}
+	if entry.flags, err = l.flags(values); err != nil {
+		return nil, nil, err
+	}
+	return entry, extra, nil
+}
+
+func inList(value string, list []string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *configLoader) listener(node *yaml.Node) (*configEntry, error) {
+	entry, _, err := l.entry(node, "listener", flagNames(addListenerFlags))
+	if err != nil {
+		return nil, err
+	}
+	if strings.Index(entry.address, "://") == -1 {
+		entry.address = "udp://" + entry.address
+	}
+	entry.name = entry.address
+	if _, err := net.NewListener(entry.address, nil); err != nil {
+		return nil, l.error(node, "%s", err.Error())
+	}
+	if _, err := getAccessList(entry.flags); err != nil {
+		return nil, l.error(node, "listener '%s': %s", entry.name, err.Error())
+	}
+	if _, err := getRateLimiter(entry.flags); err != nil {
+		return nil, l.error(node, "listener '%s': %s", entry.name, err.Error())
+	}
+	return entry, nil
+}
+
+func (l *configLoader) output(node *yaml.Node) (*configEntry, error) {
+	entry, extra, err := l.entry(node, "output", flagNames(addOutputFlags), "name")
+	if err != nil {
+		return nil, err
+	}
+	if strings.Index(entry.address, "://") == -1 {
+		entry.address = "tcp+ssl://" + entry.address
+	}
+	if entry.name = extra["name"]; entry.name == "" {
+		entry.name = entry.address
+	}
+	if net.NewGraylogHost(entry.address) == nil {
+		return nil, l.error(node, "invalid address '%s' for output '%s', see \"help host\"", entry.address, entry.name)
+	}
+	if _, err := getConnOptions(entry.flags); err != nil {
+		return nil, l.error(node, "output '%s': %s", entry.name, err.Error())
+	}
+	return entry, nil
+}
+
+// route reads a route like:
+//
+//	match: {level: 3, host: "web-*", _app: api}
+//	outputs: [graylog]
+func (l *configLoader) route(node *yaml.Node, outputs map[string]bool) (*configRoute, error) {
+	content, err := l.mapping(node, "a route")
+	if err != nil {
+		return nil, err
+	}
+	var route = &configRoute{line: node.Line, outputs: []string{}}
+	var match []string
+	var found bool
+	for i := 0; i < len(content); i += 2 {
+		key, value := content[i], content[i+1]
+		switch key.Value {
+		case "match":
+			fields, err := l.mapping(value, "the match of a route")
+			if err != nil {
+				return nil, err
+			}
+			for j := 0; j < len(fields); j += 2 {
+				if fields[j+1].Kind != yaml.ScalarNode {
+					return nil, l.error(fields[j+1], "expected a value for the match on '%s'", fields[j].Value)
+				}
+				match = append(match, fields[j].Value+"="+fields[j+1].Value)
+			}
+			if route.filter, err = net.ParseTailFilter(match); err != nil {
+				return nil, l.error(value, "%s", err.Error())
+			}
+		case "outputs":
+			items, err := l.sequence(value, "the outputs of a route")
+			if err != nil {
+				return nil, err
+			}
+			for _, item := range items {
+				if !outputs[item.Value] {
+					return nil, l.error(item, "unknown output '%s', expected one of %s", item.Value, sortedNames(outputs))
+				}
+				route.outputs = append(route.outputs, item.Value)
+			}
+			found = true
+		default:
+			return nil, l.error(key, "unknown option '%s' for a route, expected match or outputs", key.Value)
+		}
+	}
+	if !found {
+		return nil, l.error(node, "missing the outputs of the route, use an empty list to drop the messages")
+	}
+	return route, nil
+}
+
+// load will read and validate the config file
+func (l *configLoader) load() (*listenConfig, error) {
+	raw, err := os.ReadFile(l.file)
+	if err != nil {
+		return nil, err
+	}
+	var document yaml.Node
+	if err := yaml.Unmarshal(raw, &document); err != nil {
+		return nil, fmt.Errorf("%s: %s", l.file, err.Error())
+	}
+	if len(document.Content) == 0 {
+		return nil, fmt.Errorf("%s: the config file is empty", l.file)
+	}
+	content, err := l.mapping(document.Content[0], "the config")
+	if err != nil {
+		return nil, err
+	}
+	var sections = make(map[string]*yaml.Node)
+	var cli = flagNames(func(set *pflag.FlagSet) {
+		new(Container).AddFlags(set)
+		set.String("config", "", "")
+	})
+	var names = flagNames(func(set *pflag.FlagSet) {
+		addListenFlags(set)
+		addListenerFlags(set)
+		addOutputFlags(set)
+	})
+	for i := 0; i < len(content); i += 2 {
+		key, value := content[i], content[i+1]
+		switch {
+		case key.Value == "listeners" || key.Value == "outputs" || key.Value == "routes":
+			sections[key.Value] = value
+		case key.Value == "cwd" || names[key.Value]:
+			l.defaults = append(l.defaults, key, value)
+		case cli[key.Value]:
+			return nil, l.error(key, "the option '%s' can only be set on the command line", key.Value)
+		default:
+			return nil, l.error(key, "unknown option '%s'", key.Value)
+		}
+	}
+	var config = new(listenConfig)
+	if config.flags, err = l.flags(nil); err != nil {
+		return nil, err
+	}
+	if _, err := getBudget(config.flags); err != nil {
+		return nil, l.error(document.Content[0], "%s", err.Error())
+	}
+	if _, err := getLogForwardLevel(config.flags); err != nil {
+		return nil, l.error(document.Content[0], "%s", err.Error())
+	}
+	if node, ok := sections["listeners"]; ok {
+		items, err := l.sequence(node, "the listeners")
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			listener, err := l.listener(item)
+			if err != nil {
+				return nil, err
+			}
+			config.listeners = append(config.listeners, listener)
+		}
+	}
+	if len(config.listeners) == 0 {
+		return nil, fmt.Errorf("%s: no listeners configured", l.file)
+	}
+	var outputs = make(map[string]bool)
+	if node, ok := sections["outputs"]; ok {
+		items, err := l.sequence(node, "the outputs")
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			output, err := l.output(item)
+			if err != nil {
+				return nil, err
+			}
+			if outputs[output.name] {
+				return nil, l.error(item, "duplicate output '%s'", output.name)
+			}
+			outputs[output.name] = true
+			config.outputs = append(config.outputs, output)
+		}
+	}
+	if isPrint, _ := config.flags.GetBool("print"); len(config.outputs) == 0 && !isPrint {
+		return nil, fmt.Errorf("%s: no outputs configured", l.file)
+	}
+	if node, ok := sections["routes"]; ok {
+		items, err := l.sequence(node, "the routes")
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			route, err := l.route(item, outputs)
+			if err != nil {
+				return nil, err
+			}
+			config.routes = append(config.routes, route)
+		}
+	}
+	return config, nil
+}
+
+// loadListenConfig will read the config file, the flags that are set
+// on the command line override the values of the config file
+func loadListenConfig(file string, cli *pflag.FlagSet, container *Container) (*listenConfig, error) {
+	return (&configLoader{file: file, cli: cli, container: container}).load()
+}
@@ -0,0 +1,222 @@
+package command
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pbergman/app"
+	"github.com/pbergman/graylog-proxy/net"
+	"github.com/pbergman/logger"
+	"github.com/spf13/pflag"
+)
+
+func NewConfigCheckCommand() app.CommandInterface {
+	return &ConfigCheckCommand{
+		app.Command{
+			Flags: new(pflag.FlagSet),
+			Name:  "config:check",
+			Usage: "[options] [--] (CONFIG)",
+			Short: "Validate a listen config file",
+			Long: `The config:check command reads a config file of the listen command (see the config flag of the listen command) and
+validates it without starting the listeners or connecting to the outputs, so it can be run before a proxy is (re)started.
+
+Besides the validation done when the config is loaded (the options, the listener and output addresses and the routes)
+the CA, client certificate and private key of every secure output are loaded and the client certificate is verified
+against the CA. The expire date of the certificates is reported and certificates that expire within the expiry warning
+are reported as a warning. With the handshake flag a tls handshake is done with every secure output to verify the
+remote with the configured CA, server name and pins.
+
+Every check is printed on its own line prefixed with ok, warning or error and the command exits with a non zero exit
+code when one of the checks failed.
+
+Arguments:
+    CONFIG                  the YAML config file of the listen command
+
+Options:
+    --quiet                 Disable the application output
+    --verbose (-v,-vv,-vvv) Increase the verbosity of application output
+    --log-format            The format of the application output, text or json with one object per line (default text)
+    --handshake             Do a tls handshake with every secure output
+    --timeout               The max time for connecting and the handshake with an output (default 10s)
+    --expiry-warning        Report the certificates that expire within this time as a warning (default 720h)
+
+Example:
+    {{ exec_bin }} config:check /etc/graylog-proxy/config.yaml
+    {{ exec_bin }} config:check --handshake --expiry-warning=336h /etc/graylog-proxy/config.yaml
+`,
+		},
+	}
+}
+
+type ConfigCheckCommand struct {
+	app.Command
+}
+
+func (c *ConfigCheckCommand) Init(a *app.App) error {
+	a.Container.(*Container).AddFlags(c.Flags.(*pflag.FlagSet))
+	c.Flags.(*pflag.FlagSet).Bool("handshake", false, "")
+	c.Flags.(*pflag.FlagSet).Lookup("handshake").NoOptDefVal = "true"
+	c.Flags.(*pflag.FlagSet).Duration("timeout", 10*time.Second, "")
+	c.Flags.(*pflag.FlagSet).Duration("expiry-warning", 30*24*time.Hour, "")
+	return nil
+}
+
+// configCheck prints the result of the checks and keeps count of the failures
+type configCheck struct {
+	warning time.Duration
+	errors  int
+}
+
+func (c *configCheck) ok(format string, args ...interface{}) {
+	fmt.Printf("ok       "+format+"\n", args...)
+}
+
+func (c *configCheck) warn(format string, args ...interface{}) {
+	fmt.Printf("warning  "+format+"\n", args...)
+}
+
+func (c *configCheck) fail(format string, args ...interface{}) {
+	c.errors++
+	fmt.Printf("error    "+format+"\n", args...)
+}
+
+// expiry reports the expire date of the certificate
+func (c *configCheck) expiry(prefix string, certificate *x509.Certificate) {
+	var until = time.Until(certificate.NotAfter)
+	var message = fmt.Sprintf(
+		"%s '%s' expires %s (in %d days)",
+		prefix,
+		certificate.Subject.String(),
+		certificate.NotAfter.Format(time.RFC3339),
+		int(until.Hours()/24),
+	)
+	switch {
+	case until <= 0:
+		c.fail("%s '%s' expired at %s", prefix, certificate.Subject.String(), certificate.NotAfter.Format(time.RFC3339))
+	case time.Now().Before(certificate.NotBefore):
+		c.fail("%s '%s' is not valid before %s", prefix, certificate.Subject.String(), certificate.NotBefore.Format(time.RFC3339))
+	case until < c.warning:
+		c.warn("%s", message)
+	default:
+		c.ok("%s", message)
+	}
+}
+
+// tls will load and verify the certificates of a secure output
+func (c *configCheck) tls(entry *configEntry, logger *logger.Logger) {
+	options, err := getTlsOptions(entry.flags)
+	if err != nil {
+		c.fail("output '%s': %s", entry.name, err.Error())
+		return
+	}
+	check, err := net.CheckTls(&options, logger)
+	if err != nil {
+		c.fail("output '%s': %s", entry.name, err.Error())
+		return
+	}
+	if len(check.Roots) == 0 && !options.InsecureSkipVerify {
+		c.ok("output '%s': using the system root certificates", entry.name)
+	}
+	for _, root := range check.Roots {
+		c.expiry(fmt.Sprintf("output '%s': ca '%s'", entry.name, options.CA), root)
+	}
+	if check.Certificate != nil {
+		c.expiry(fmt.Sprintf("output '%s': certificate '%s'", entry.name, options.Crt), check.Certificate)
+	}
+}
+
+// handshakeAddress returns the address (host:port) and host of the secure output
+func handshakeAddress(host *net.GraylogHost) (string, string, error) {
+	remote, err := url.Parse(host.String())
+	if err != nil {
+		return "", "", err
+	}
+	if host.GetNetwork() == "https" && remote.Port() == "" {
+		return remote.Hostname() + ":443", remote.Hostname(), nil
+	}
+	return remote.Host, remote.Hostname(), nil
+}
+
+// handshake will connect to the secure output and do a tls handshake
+func (c *configCheck) handshake(entry *configEntry, host *net.GraylogHost, timeout time.Duration, logger *logger.Logger) {
+	options, err := getConnOptions(entry.flags)
+	if err != nil {
+		c.fail("output '%s': %s", entry.name, err.Error())
+		return
+	}
+	address, hostname, err := handshakeAddress(host)
+	if err != nil {
+		c.fail("output '%s': %s", entry.name, err.Error())
+		return
+	}
+	loader, err := net.NewTlsLoader(&options.Tls, logger)
+	if err != nil {
+		c.fail("output '%s': %s", entry.name, err.Error())
+		return
+	}
+	defer loader.Close()
+	dialer := &net.Dialer{Proxy: options.Proxy, Remote: entry.name}
+	dialer.Timeout = timeout
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	network := "tcp"
+	if strings.HasPrefix(host.GetNetwork(), "tcp") {
+		network = host.GetNetwork()
+	}
+	conn, err := dialer.DialTlsContext(ctx, network, address, loader.Config(hostname))
+	if err != nil {
+		c.fail("output '%s': handshake with '%s' failed: %s", entry.name, address, err.Error())
+		return
+	}
+	defer conn.Close()
+	c.ok("output '%s': handshake with '%s' succeeded", entry.name, address)
+	if state := conn.(*tls.Conn).ConnectionState(); len(state.PeerCertificates) > 0 {
+		c.expiry(fmt.Sprintf("output '%s': remote certificate", entry.name), state.PeerCertificates[0])
+	}
+}
+
+func (c *ConfigCheckCommand) Run(args []string, app *app.App) error {
+	if s := len(args); s != 1 {
+		return fmt.Errorf("invalid arguments, expected 1 got %d", s)
+	}
+	var container = app.Container.(*Container)
+	var set = c.Flags.(*pflag.FlagSet)
+	config, err := loadListenConfig(args[0], newListenFlagSet(container), container)
+	if err != nil {
+		return err
+	}
+	handshake, _ := set.GetBool("handshake")
+	timeout, _ := set.GetDuration("timeout")
+	check := new(configCheck)
+	check.warning, _ = set.GetDuration("expiry-warning")
+	for _, listener := range config.listeners {
+		check.ok("listener '%s'", listener.name)
+	}
+	for _, output := range config.outputs {
+		host := net.NewGraylogHost(output.address)
+		check.ok("output '%s': %s", output.name, output.address)
+		if !host.IsSecure() {
+			continue
+		}
+		check.tls(output, container.GetLogger())
+		if handshake {
+			check.handshake(output, host, timeout, container.GetLogger())
+		}
+	}
+	for _, route := range config.routes {
+		if len(route.outputs) == 0 {
+			check.ok("route on line %d drops the matching messages", route.line)
+		} else {
+			check.ok("route on line %d sends the matching messages to '%s'", route.line, strings.Join(route.outputs, "', '"))
+		}
+	}
+	if check.errors > 0 {
+		return fmt.Errorf("the config '%s' has %d error(s)", args[0], check.errors)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package command
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+// writeConfig will write the config to a file in a temporary directory
+func writeConfig(t *testing.T, config string) string {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte(strings.TrimLeft(config, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// testConfig will write the config to a file and loads it with the given command line arguments
+func testConfig(t *testing.T, config string, args ...string) (*listenConfig, string, error) {
+	file := writeConfig(t, config)
+	container := new(Container)
+	cli := newListenFlagSet(container)
+	if err := cli.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadListenConfig(file, cli, container)
+	return loaded, file, err
+}
+
+func TestLoadListenConfig_errors(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		config string
+		line   int
+		error  string
+	}{
+		{"unknown option", `
+listeners: [{address: "127.0.0.1:12201"}]
+outputs: [{address: "tcp://127.0.0.1:12201"}]
+unknown: true
+`, 3, "unknown option 'unknown'"},
+		{"command line option", `
+quiet: true
+listeners: [{address: "127.0.0.1:12201"}]
+`, 1, "the option 'quiet' can only be set on the command line"},
+		{"unknown listener option", `
+listeners:
+  - address: "127.0.0.1:12201"
+    workers: 2
+`, 3, "unknown option 'workers' for a listener"},
+		{"unknown output option", `
+listeners: [{address: "127.0.0.1:12201"}]
+outputs:
+  - address: "tcp://127.0.0.1:12201"
+    allow: 10.0.0.0/8
+`, 4, "unknown option 'allow' for a output"},
+		{"list for a single value", `
+listeners: [{address: "127.0.0.1:12201"}]
+outputs:
+  - address: "tcp://127.0.0.1:12201"
+    workers: [1, 2]
+`, 4, "invalid value for 'workers': expected a single value not a list"},
+		{"invalid value", `
+workers: many
+listeners: [{address: "127.0.0.1:12201"}]
+`, 1, "invalid value for 'workers'"},
+		{"missing address", `
+listeners:
+  - allow: 10.0.0.0/8
+`, 2, "missing the address of the listener"},
+		{"invalid listener", `
+listeners:
+  - address: "tcp://127.0.0.1:12201"
+`, 2, "invalid (connectionless) address"},
+		{"duplicate output", `
+listeners: [{address: "127.0.0.1:12201"}]
+outputs:
+  - {name: graylog, address: "tcp://127.0.0.1:12201"}
+  - {name: graylog, address: "udp://127.0.0.1:12201"}
+`, 4, "duplicate output 'graylog'"},
+		{"unknown route output", `
+listeners: [{address: "127.0.0.1:12201"}]
+outputs:
+  - {name: graylog, address: "tcp://127.0.0.1:12201"}
+routes:
+  - match: {level: 3}
+    outputs: [graylog, alerts]
+`, 6, "unknown output 'alerts', expected one of graylog"},
+		{"route without outputs", `
+listeners: [{address: "127.0.0.1:12201"}]
+outputs:
+  - {name: graylog, address: "tcp://127.0.0.1:12201"}
+routes:
+  - match: {level: 3}
+`, 5, "missing the outputs of the route"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, file, err := testConfig(t, test.config)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if prefix := fmt.Sprintf("%s:%d: ", file, test.line); !strings.HasPrefix(err.Error(), prefix) || !strings.Contains(err.Error(), test.error) {
+				t.Fatalf("expected an error starting with '%s' containing '%s' got '%s'", prefix, test.error, err.Error())
+			}
+		})
+	}
+}
+
+func TestLoadListenConfig(t *testing.T) {
+	const config = `
+workers: 5
+allow: 10.0.0.0/8
+listeners:
+  - address: "127.0.0.1:12201"
+  - address: "udp://127.0.0.1:12202"
+    allow: [192.168.0.0/16, 10.1.0.0/16]
+outputs:
+  - name: graylog
+    address: "tcp://127.0.0.1:12201"
+  - address: "udp://127.0.0.1:12202"
+    workers: 2
+routes:
+  - match: {level: 3}
+    outputs: [graylog]
+  - outputs: []
+`
+	var slice = func(set *pflag.FlagSet, name string) []string {
+		values, _ := set.GetStringSlice(name)
+		return values
+	}
+	for _, test := range []struct {
+		name    string
+		args    []string
+		workers []int
+		allow   [][]string
+	}{
+		{"config", nil, []int{5, 2}, [][]string{{"10.0.0.0/8"}, {"192.168.0.0/16", "10.1.0.0/16"}}},
+		{"command line", []string{"--workers=3", "--allow=172.16.0.0/12"}, []int{3, 3}, [][]string{{"172.16.0.0/12"}, {"172.16.0.0/12"}}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			loaded, _, err := testConfig(t, config, test.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(loaded.listeners) != 2 || loaded.listeners[0].name != "udp://127.0.0.1:12201" || loaded.listeners[1].name != "udp://127.0.0.1:12202" {
+				t.Fatalf("unexpected listeners %+v", loaded.listeners)
+			}
+			if len(loaded.outputs) != 2 || loaded.outputs[0].name != "graylog" || loaded.outputs[1].name != "udp://127.0.0.1:12202" {
+				t.Fatalf("unexpected outputs %+v", loaded.outputs)
+			}
+			for i, output := range loaded.outputs {
+				if workers := getIntVar(output.flags, "workers"); workers != test.workers[i] {
+					t.Fatalf("expected %d workers for output '%s' got %d", test.workers[i], output.name, workers)
+				}
+			}
+			for i, listener := range loaded.listeners {
+				if allow := slice(listener.flags, "allow"); !reflect.DeepEqual(allow, test.allow[i]) {
+					t.Fatalf("expected %v allowed for listener '%s' got %v", test.allow[i], listener.name, allow)
+				}
+			}
+			if workers := getIntVar(loaded.flags, "workers"); workers != test.workers[0] {
+				t.Fatalf("expected %d workers for the top level got %d", test.workers[0], workers)
+			}
+			if len(loaded.routes) != 2 || loaded.routes[0].line != 13 || !reflect.DeepEqual(loaded.routes[0].outputs, []string{"graylog"}) || len(loaded.routes[1].outputs) != 0 {
+				t.Fatalf("unexpected routes %+v", loaded.routes)
+			}
+		})
+	}
+}
@@ -1,9 +1,16 @@
 package command
 
 import (
+	"encoding/json"
+	"fmt"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pbergman/app"
+	"github.com/pbergman/graylog-proxy/net"
 	"github.com/pbergman/logger"
 	"github.com/spf13/pflag"
 )
@@ -12,6 +19,9 @@ type Container struct {
 	app     *app.App
 	flags   *pflag.FlagSet
 	logger  *logger.Logger
+	level   *levelHandler
+	gelf    *net.GelfLogHandler
+	version string
 	current app.CommandInterface
 }
 
@@ -27,10 +37,32 @@ func (c *Container) GetCurrent() app.CommandInterface {
 	return c.current
 }
 
+// logFormat is the value of the log-format flag, only
+// the text and json formats are accepted when parsing
+type logFormat string
+
+func (l *logFormat) String() string {
+	return string(*l)
+}
+
+func (l *logFormat) Set(value string) error {
+	if value != "text" && value != "json" {
+		return fmt.Errorf("invalid log format '%s', expected text or json", value)
+	}
+	*l = logFormat(value)
+	return nil
+}
+
+func (l *logFormat) Type() string {
+	return "string"
+}
+
 func (c *Container) AddFlags(set *pflag.FlagSet) {
+	format := logFormat("text")
 	set.BoolP("quiet", "q", false, "")
 	set.StringP("cwd", "c", os.Getenv("PWD"), "")
 	set.BoolSliceP("verbose", "v", []bool{}, "")
+	set.Var(&format, "log-format", "")
 	set.BoolP("help", "h", false, "")
 	set.Lookup("help").NoOptDefVal = "true"
 	set.Lookup("verbose").NoOptDefVal = "true"
@@ -71,6 +103,19 @@ func (c *Container) GetFlags() *pflag.FlagSet {
 	return c.flags
 }
 
+// SetVersion will set the version of the application as set on build
+func (c *Container) SetVersion(version string) {
+	c.version = version
+}
+
+// GetVersion returns the version of the application, dev when not set on build
+func (c *Container) GetVersion() string {
+	if c.version == "" {
+		return "dev"
+	}
+	return c.version
+}
+
 func (c *Container) GetApp() *app.App {
 	return c.app
 }
@@ -84,22 +129,99 @@ func (c *Container) GetVerboseLevel() int {
 	return len(size)
 }
 
+// verboseLogLevel returns the log level for the given verbosity,
+// a negative verbosity will disable the output (quiet)
+func verboseLogLevel(verbosity int) logger.LogLevel {
+	switch {
+	case verbosity < 0: // quiet
+		return 0
+	case verbosity == 0: // normal
+		return logger.LogLevelWarning()
+	case verbosity == 1: // verbose
+		return logger.LogLevelNotice()
+	case verbosity == 2: // very verbose
+		return logger.LogLevelInfo()
+	default: // debug
+		return logger.LogLevelDebug()
+	}
+}
+
+// textLogFormat writes the message without the context, the
+// context is only used for the json output
+var textLogFormat, _ = logger.NewLineFormatter("[{{ .Time.Format \"2006-01-02 15:04:05.000000\" }}] {{ .Name }}.{{ .Level }}: {{ .Message }}\n")
+
+// jsonLogFormat writes the record as one JSON object where the
+// context (like the message id and remote) are separate keys
+func jsonLogFormat(record *logger.Record) ([]byte, error) {
+	fields := make(map[string]interface{}, len(record.Context)+4)
+	for key, value := range record.Context {
+		fields[key] = value
+	}
+	fields["time"] = record.Time.Format(time.RFC3339Nano)
+	fields["channel"] = record.Name
+	fields["level"] = strings.ToLower(record.Level.String())
+	fields["message"] = record.Message
+	buf, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, '\n'), nil
+}
+
+// levelHandler will only pass the records of the level to the handler,
+// the level can be changed while running (see SetVerboseLevel). The
+// records are passed one at a time because the formatters of the
+// writer handler use a shared buffer.
+type levelHandler struct {
+	handler logger.HandlerInterface
+	level   uint32
+	lock    sync.Mutex
+}
+
+func (l *levelHandler) IsHandling(r *logger.Record) bool {
+	return r.Level.Match(logger.LogLevel(atomic.LoadUint32(&l.level)))
+}
+
+func (l *levelHandler) Handle(r *logger.Record) bool {
+	if !l.IsHandling(r) {
+		return false
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.handler.Handle(r)
+}
+
+// SetVerboseLevel will change the verbosity of the logger, where
+// -1 is quiet, 0 normal and 1, 2 or 3 the same as -v, -vv or -vvv.
+func (c *Container) SetVerboseLevel(verbosity int) {
+	c.GetLogger()
+	atomic.StoreUint32(&c.level.level, uint32(verboseLogLevel(verbosity)))
+}
+
+// GetLogHandler returns the handler that can forward the logs as GELF messages
+func (c *Container) GetLogHandler() *net.GelfLogHandler {
+	c.GetLogger()
+	return c.gelf
+}
+
 func (c *Container) GetLogger() *logger.Logger {
 	if c.logger == nil {
-		var handler []logger.HandlerInterface
-		if ok, _ := c.flags.GetBool("quiet"); !ok {
-			switch c.GetVerboseLevel() {
-			case 0: // normal
-				handler = append(handler, logger.NewWriterHandler(os.Stdout, logger.LogLevelWarning(), false))
-			case 1: // verbose
-				handler = append(handler, logger.NewWriterHandler(os.Stdout, logger.LogLevelNotice(), false))
-			case 2: // very verbose
-				handler = append(handler, logger.NewWriterHandler(os.Stdout, logger.LogLevelInfo(), false))
-			default: // debug
-				handler = append(handler, logger.NewWriterHandler(os.Stdout, logger.LogLevelDebug(), false))
-			}
+		var verbosity = c.GetVerboseLevel()
+		if ok, _ := c.flags.GetBool("quiet"); ok {
+			verbosity = -1
+		}
+		handler := logger.NewWriterHandler(os.Stdout, logger.LogLevelDebug(), false)
+		if format, _ := c.flags.GetString("log-format"); format == "json" {
+			handler.(logger.FormatHandlerInterface).SetFormatter(logger.F(jsonLogFormat))
+		} else {
+			handler.(logger.FormatHandlerInterface).SetFormatter(textLogFormat)
+		}
+		c.level = &levelHandler{
+			handler: handler,
+			level:   uint32(verboseLogLevel(verbosity)),
 		}
-		c.logger = logger.NewLogger("main", handler...)
+		c.gelf = net.NewGelfLogHandler()
+		c.logger = logger.NewLogger("main", c.level, c.gelf)
 	}
 
 	if curr := c.GetCurrent(); curr != nil {
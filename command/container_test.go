@@ -0,0 +1,36 @@
+package command
+
+import (
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+func TestContainer_AddFlags_logFormat(t *testing.T) {
+	for _, test := range []struct {
+		args   []string
+		format string
+		valid  bool
+	}{
+		{nil, "text", true},
+		{[]string{"--log-format=json"}, "json", true},
+		{[]string{"--log-format=text"}, "text", true},
+		{[]string{"--log-format=xml"}, "", false},
+	} {
+		set := pflag.NewFlagSet("test", pflag.ContinueOnError)
+		new(Container).AddFlags(set)
+		err := set.Parse(test.args)
+		if !test.valid {
+			if err == nil {
+				t.Fatalf("expected %v to fail", test.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if format, _ := set.GetString("log-format"); format != test.format {
+			t.Fatalf("expected format '%s' got '%s'", test.format, format)
+		}
+	}
+}
@@ -30,6 +30,7 @@ Arguments:
 Options:
     --quiet                 Disable the application output
     --verbose (-v,-vv,-vvv) Increase the verbosity of application output
+    --log-format            The format of the application output, text or json with one object per line (default text)
     --cwd (-c)              Set the current working directory (default '{{ .Env "PWD" }})
     --bits (-b)             The bits size used for creating the private key (default 2048)
     --force (-f)            Overwrite the files if exists (this will invalidate all allready created certificates and keys)
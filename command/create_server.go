@@ -26,6 +26,7 @@ Arguments:
 Options:
     --quiet                 Disable the application output
     --verbose (-v,-vv,-vvv) Increase the verbosity of application output
+    --log-format            The format of the application output, text or json with one object per line (default text)
     --bits (-b)             The bits size used for creating the private key (default 2048)
     --cwd (-c)              Set the current working directory (default '{{ .Env "PWD" }})
     --force (-f)            Overwrite the files if exists
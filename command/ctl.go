@@ -0,0 +1,82 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pbergman/app"
+	"github.com/pbergman/graylog-proxy/net"
+	"github.com/spf13/pflag"
+)
+
+func NewCtlCommand() app.CommandInterface {
+	return &CtlCommand{
+		app.Command{
+			Flags: new(pflag.FlagSet),
+			Name:  "ctl",
+			Usage: "[options] [--] (COMMAND) [ARGS...]",
+			Short: "Control a running listen process",
+			Long: `The ctl command sends a command to the admin socket of a running listen process (see the admin-socket flag of the
+listen command) and prints the result.
+
+Commands:
+    pause                   Stop delivering messages to the remotes, the messages are queued in the meantime and when the
+                            queue is full the least severe messages are dropped
+    resume                  Continue delivering the queued messages
+    flush [TIMEOUT]         Write the collected messages without waiting for the flush delay and wait till the queue is
+                            empty (default timeout 30s)
+    verbosity (LEVEL)       Change the verbosity of the output, quiet, normal, verbose, very-verbose or debug
+    reload                  Reload the certificates used for new connections
+    state                   Dump the state of the listeners, the pools and their queues
+
+Options:
+    --quiet                 Disable the application output
+    --verbose (-v,-vv,-vvv) Increase the verbosity of application output
+    --log-format            The format of the application output, text or json with one object per line (default text)
+    --socket (-s)           The path of the admin socket (default ./graylog-proxy.sock)
+    --timeout               The max time to wait for the response (default 1m)
+
+Example:
+    {{ exec_bin }} listen --admin-socket=/run/graylog-proxy.sock 127.0.0.1:12201 tcp://example.logger.com:12201
+    {{ exec_bin }} ctl --socket=/run/graylog-proxy.sock verbosity debug
+`,
+		},
+	}
+}
+
+type CtlCommand struct {
+	app.Command
+}
+
+func (c *CtlCommand) Init(a *app.App) error {
+	a.Container.(*Container).AddFlags(c.Flags.(*pflag.FlagSet))
+	c.Flags.(*pflag.FlagSet).StringP("socket", "s", "./graylog-proxy.sock", "")
+	c.Flags.(*pflag.FlagSet).Duration("timeout", time.Minute, "")
+	return nil
+}
+
+func (c *CtlCommand) Run(args []string, app *app.App) error {
+	if len(args) < 1 {
+		return fmt.Errorf("invalid arguments, expected at least 1 got %d", len(args))
+	}
+	socket, _ := c.Flags.(*pflag.FlagSet).GetString("socket")
+	timeout, _ := c.Flags.(*pflag.FlagSet).GetDuration("timeout")
+	response, err := net.AdminCall(socket, args[0], args[1:], timeout)
+	if err != nil {
+		return err
+	}
+	switch result := response.Result.(type) {
+	case nil:
+		fmt.Println("ok")
+	case string:
+		fmt.Println(result)
+	default:
+		out, err := json.MarshalIndent(result, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+	}
+	return nil
+}
@@ -29,6 +29,7 @@ Arguments:
 Options:
     --quiet                 Disable the application output
     --verbose (-v,-vv,-vvv) Increase the verbosity of application output
+    --log-format            The format of the application output, text or json with one object per line (default text)
     --cwd (-c)              Set the current working directory (default '{{ .Env "PWD" }})
     --full-message          Full message that will be used for the GELF payload (default will be a stack trace)
     --short-message         Short message that will be used for the GELF payload (default 'example stack trace')
@@ -37,13 +38,49 @@ Options:
     --level                 Level for the GELF payload (default 1)
     --dump                  Write a hexdump of the message that's going to be send to the server.
     --new-line              Use new line delimiter instead of a null byte
-    --no-client-auth        Will nog load certificates hen using a secure scheme
+    --no-client-auth        Do not present a client certificate when using a secure scheme, the remote is still verified
+                            with the CA certificate or with the system root certificates when the CA file does not exist
+    --tls-server-name       The server name used for verifying the remote certificate (default the remote host)
+    --tls-min-version       The minimum tls version, 1.0, 1.1, 1.2 or 1.3
+    --tls-ciphers           The enabled cipher suites for tls 1.2 and lower (comma separated, for example
+                            TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256)
+    --tls-system-roots      Merge the system root certificates with the CA certificate(s)
+    --tls-insecure-skip-verify
+                            Do not verify the remote certificate, only use this for lab setups!
+    --tls-session-cache     The amount of tls sessions cached for resumption, 0 disables resumption (default 64)
+    --tls-reload-interval   The interval for checking the certificate files for changes, 0 disables it (default 30s)
+    --tls-pin               Pin the public key of the remote, a base64 encoded SHA-256 hash of the public key (SPKI)
+                            optionally prefixed with sha256/ (can be repeated or comma separated for key rotation)
     --pem                   The file name for the client private key (default ./Client.pem)
     --crt                   The file name for the client certificate (default ./Client.crt)
-    --ca                    The file name for the CA certificate (default ./CA_Root.crt)
+    --ca                    The file name for the CA certificate(s) or a directory with CA certificates (default ./CA_Root.crt)
+    --header                Add a header to every request for a http(s) remote, format 'Name: value' (can be repeated)
+    --http-user             The user used for basic authentication on a http(s) remote
+    --http-password-file    The file to read the basic authentication password from
+    --http-password-env     The environment variable to read the basic authentication password from
+    --http-token-file       The file to read the bearer token from for a http(s) remote
+    --http-token-env        The environment variable to read the bearer token from for a http(s) remote
+    --proxy                 Connect to a tcp or http(s) remote through a proxy, the url should have the scheme http (for
+                            a proxy supporting CONNECT) or socks5 and can contain a user (http://user@proxy:3128)
+    --proxy-password-file   The file to read the proxy password from
+    --proxy-password-env    The environment variable to read the proxy password from
+    --resolve-interval      The time the addresses of the remote are cached (default 1m), when expired or when none of
+                            the addresses can be connected the remote is resolved again. All addresses are tried.
+    --write-timeout         The deadline for writing a message to a tcp remote (default 30s, 0 to disable)
+    --conn-max-age          The max lifetime of a connection to a tcp remote before it is replaced (default 0, disabled)
+    --flush-size            The amount of bytes of queued messages that are written at once to a tcp remote (default
+                            65536, 0 will write every message on its own)
+    --flush-delay           The max time to wait for more messages before a write when the flush size is not reached
+                            (default 0, only messages that are already queued are written together)
+    --queue-size            The max amount of queued messages (default 1000), the most severe messages are send first
+                            and when full the least severe messages are dropped. Critical, alert and emergency messages
+                            are never dropped, these will wait for room in the queue.
+    --compress              The compression used for a udp remote, gzip, zlib or none (default gzip)
+    --chunk-size            The max chunk size for a udp remote, lan, wan or a size in bytes (default lan)
 
 Example:
     {{ exec_bin }} debug:client --pem=client.pem --crt=client.crt --ca=root.crt tcp+tls://example.logger.com:12201
+    {{ exec_bin }} debug:client --chunk-size=512 udp://example.logger.com:12201
 
 `,
 			},
@@ -59,20 +96,16 @@ func (c *DebugClientCommand) Init(a *app.App) error {
 	if err := c.create.Init(a); err != nil {
 		return err
 	}
-	c.Flags.(*pflag.FlagSet).String("pem", "Client.pem", "")
-	c.Flags.(*pflag.FlagSet).String("crt", "Client.crt", "")
-	c.Flags.(*pflag.FlagSet).String("ca", "CA_Root.crt", "")
 	c.Flags.(*pflag.FlagSet).String("full-message", "", "")
 	c.Flags.(*pflag.FlagSet).IntP("tries", "t", 5, "")
 	c.Flags.(*pflag.FlagSet).String("short-message", "example stack trace", "")
 	c.Flags.(*pflag.FlagSet).String("host", "", "")
 	c.Flags.(*pflag.FlagSet).Bool("new-line", false, "")
 	c.Flags.(*pflag.FlagSet).Bool("dump", false, "")
-	c.Flags.(*pflag.FlagSet).Bool("no-client-auth", false, "")
 	c.Flags.(*pflag.FlagSet).Int8("level", 1, "")
 	c.Flags.(*pflag.FlagSet).Lookup("new-line").NoOptDefVal = "true"
-	c.Flags.(*pflag.FlagSet).Lookup("no-client-auth").NoOptDefVal = "true"
 	c.Flags.(*pflag.FlagSet).Lookup("dump").NoOptDefVal = "true"
+	addRemoteFlags(c.Flags.(*pflag.FlagSet))
 	return nil
 }
 
@@ -126,13 +159,14 @@ func (c DebugClientCommand) Run(args []string, app *app.App) error {
 	if host == nil {
 		return fmt.Errorf("invalid hostname provided, see \"help host\"")
 	}
+	options, err := getConnOptions(c.Flags.(*pflag.FlagSet))
+	if err != nil {
+		return err
+	}
 	pool, err := net.NewConnPool(
-		c.getBoolVar("no-client-auth"),
 		c.getIntVar("tries"),
 		host,
-		c.getFileFromFlag("ca"),
-		c.getFileFromFlag("crt"),
-		c.getFileFromFlag("pem"),
+		options,
 		app.Container.(*Container).GetLogger(),
 	)
 	if err != nil {
@@ -151,5 +185,10 @@ func (c DebugClientCommand) Run(args []string, app *app.App) error {
 	if err != nil {
 		return err
 	}
-	return nil
+	select {
+	case err := <-pool.Fatal():
+		return err
+	default:
+		return nil
+	}
 }
@@ -12,13 +12,16 @@ func NewHostCommand() app.CommandInterface {
 The host argument should be: (scheme://remote[:ip]) where scheme should be a valid scheme and remote representing the
 remote host and ip separated by a colon.
 
-This application support 2 input types ("GELF TCP" and "GELF HTTP") as input to forward the message to. Valid schemes
-for tcp are tcp, tcp4, tcp6, tcp+tls, tcp4+tls, tcp6+tls where tcp(4|6) represents an unencrypted plain connection and
-tcp[4|6]+tls represents a tls over tcp connection.
+This application support 3 input types ("GELF TCP", "GELF UDP" and "GELF HTTP") as input to forward the message to.
+Valid schemes for tcp are tcp, tcp4, tcp6, tcp+tls, tcp4+tls, tcp6+tls where tcp(4|6) represents an unencrypted plain
+connection and tcp[4|6]+tls represents a tls over tcp connection. For udp the schemes udp, udp4 and udp6 can be used
+where the messages are compressed (see --compress) and send in chunks when they are bigger than the chunk size (see
+--chunk-size).
 
 example:
 
     tcp+tls://127.0.0.1:12201   # to connect to remote 127.0.0.1 using tls over tcp on port 12201
+    udp://127.0.0.1:12201       # to send (chunked) GELF datagrams to remote 127.0.0.1 on port 12201
     http://127.0.0.1/gelf       # for a http input.
 `,
 	}
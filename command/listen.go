@@ -1,14 +1,20 @@
 package command
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"path/filepath"
-	"strings"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/pbergman/app"
 	"github.com/pbergman/graylog-proxy/net"
+	"github.com/pbergman/logger"
 	"github.com/spf13/pflag"
 )
 
@@ -17,28 +23,146 @@ func NewListenCommand() app.CommandInterface {
 		app.Command{
 			Flags: new(pflag.FlagSet),
 			Name:  "listen",
-			Usage: "[options] [--] (LOCAL_ADDRESS) [REMOTE_ADDRESS]",
+			Usage: "[options] [--] [LOCAL_ADDRESS] [REMOTE_ADDRESS]",
 			Short: "Start message forwarder",
 			Long: `This listen to the given LOCAL_ADDRESS and forward all incoming message to the REMOTE_ADDRESS. The LOCAL_ADDRESS
 and REMOTE_ADDRESS should be in the format of scheme://address and where scheme for LOCAL_ADDRESS is a connectionless
-protocol like unixgram, udp or ip and  REMOTE_ADDRESS scheme should be one of tcp, tcp+ssl, http or https (see help host).
+protocol like unixgram, udp or ip and  REMOTE_ADDRESS scheme should be one of tcp, tcp+ssl, udp, http or https (see help
+host).
+
+The client certificate, private key and CA certificate(s) are reloaded when the files change (see tls-reload-interval)
+or when the process receives a SIGHUP signal. New connections will use the reloaded certificates.
 
 When using the "print" flag the REMOTE_ADDRESS argument becomes optional and will only dump the incoming messages when
 the REMOTE_ADDRESS is not provided.
 
+Instead of the arguments a YAML config file can be given with the config flag, this can describe more than one listener
+and remote (output) and routes for sending messages to specific outputs. The keys are the names of the flags, on the top
+level these apply to all listeners and outputs and a listener or output can overwrite them. Flags given on the command
+line override the values of the config file. For example:
+
+    memory-limit: 512MB
+    listeners:
+      - address: udp://0.0.0.0:12201
+        allow: [10.0.0.0/8]
+      - address: unixgram:///run/graylog-proxy.sock
+        rate-limit-messages: 100
+    outputs:
+      - name: graylog
+        address: tcp+ssl://example.logger.com:12201
+        ca: /etc/graylog-proxy/CA_Root.crt
+      - name: archive
+        address: udp://archive.logger.com:12201
+    routes:
+      - match: {level: 3}
+        outputs: [graylog, archive]
+      - match: {host: "debug-*"}
+        outputs: []
+      - outputs: [graylog]
+
+The routes are checked in order and the first route that matches (on level or less severe, host or additional fields
+with patterns like tail) is used, a route without outputs drops the messages. When routes are configured messages that
+match no route are dropped and without routes all messages are sent to every output. The logs forwarded with the
+log-forward flag are sent to the first output. A config file can be validated before it is used with the config:check
+command.
+
+On a SIGHUP signal the config file is read again and when valid the listeners, outputs and routes are replaced. The
+listeners and outputs that did not change are kept, a listener keeps its socket when only its options changed and the
+queued messages of an output that is removed (or changed) are delivered before it is closed. The memory limits, the
+admin socket and the status server settings are only changed on a restart.
+
     --quiet                 Disable the application output
     --verbose (-v,-vv,-vvv) Increase the verbosity of application output
+    --log-format            The format of the application output, text or json with one object per line (default text)
     --cwd (-c)              Set the current working directory (default '{{ .Env "PWD" }})
+    --config                The YAML config file with the listeners, outputs and routes, the addresses are not given as
+                            arguments when used
+    --drain-timeout         The max time to wait for the queue of an output that is removed (or changed) on a reload of
+                            the config to be delivered before it is closed (default 30s, 0 to wait till delivered)
     --pem                   The file name for the client private key (default ./Client.pem)
     --crt                   The file name for the client certificate (default ./Client.crt)
-    --ca                    The file name for the CA certificate (default ./CA_Root.crt)
+    --ca                    The file name for the CA certificate(s) or a directory with CA certificates (default ./CA_Root.crt)
     --new-line              Use new line delimiter instead of a null byte
     --workers (-w)          Set the max concurrent workers for handling incoming messages (default 10)
     --print                 Print the message as the are going to be send
-    --no-client-auth        Will not load certificates when using a secure scheme
+    --inject-id             Add the id the proxy uses for a message in its logs as the _proxy_msg_id field to the GELF
+                            message, so a message in graylog can be traced back to the logs of the proxy
+    --memory-limit          The max memory used for holding received chunks and queued messages, like 512MB or 1GB,
+                            0 disables the limit (default 256MB)
+    --memory-shed-level     Above 80% of the memory limit only messages with this level or more severe are accepted
+                            so low severity messages are dropped first (default 5, notice)
+    --heartbeat-interval    The interval for sending a heartbeat GELF message to the remote with the uptime, version, the
+                            amount of received, forwarded, dropped and retried messages since the last heartbeat, the
+                            queue depth and the expiry of the client certificate (default 0, disabled)
+    --log-forward           Send the logs of the proxy with this level or more severe as GELF messages to the remote, like
+                            error or warning (default disabled). The logs about these messages and the heartbeats are not
+                            forwarded, at most 10 logs per second are forwarded (with a burst of 100) and these never take
+                            the place of a received message in a full queue.
+    --admin-socket          Serve admin commands on this unix socket so the running process can be controlled with the
+                            ctl command, like pausing the delivery or changing the verbosity, or to follow the messages
+                            with the tail command (default disabled)
+    --status-address        Serve the status of the proxy on this address (like 127.0.0.1:9180), the prometheus metrics
+                            are available on /metrics, the health on /healthz (listening) and /readyz (a healthy
+                            connection to the remote and the queue below the threshold), both return a JSON body
+                            with the state of the listener and remote (default disabled)
+    --ready-queue-threshold The percentage of the queue size that can be queued before /readyz reports the proxy as
+                            not ready (default 90)
+    --allow                 Only accept packets from these addresses or networks in CIDR notation like 172.17.0.0/16
+                            (can be repeated or comma separated, default all)
+    --deny                  Reject packets from these addresses or networks, this is checked before the allowed networks
+    --allow-uid             Only accept packets on a unix socket from processes running as one of these user ids (or
+                            one of the allowed group ids), the peer credentials are only available on linux
+    --allow-gid             Only accept packets on a unix socket from processes running with one of these group ids
+    --rate-limit-key        The key the rate limits are applied on, source for the address the messages are received
+                            from or a GELF field like host or _app (default source), the 10000 most recently used
+                            keys are tracked
+    --rate-limit-messages   The allowed messages per second for every key, 0 disables the limit (default 0)
+    --rate-limit-message-burst
+                            The max amount of messages that can be received at once (default the messages per second)
+    --rate-limit-bytes      The allowed bytes per second for every key, like 512KB, 0 disables the limit (default 0)
+    --rate-limit-byte-burst The max amount of bytes that can be received at once (default the bytes per second)
+    --rate-limit-summary    The interval for logging the keys that exceeded the limits (default 1m)
+    --rate-limit-report     Also send the summary of the keys that exceeded the limits as GELF message to the remote
+    --no-client-auth        Do not present a client certificate when using a secure scheme, the remote is still verified
+                            with the CA certificate or with the system root certificates when the CA file does not exist
+    --tls-server-name       The server name used for verifying the remote certificate (default the remote host)
+    --tls-min-version       The minimum tls version, 1.0, 1.1, 1.2 or 1.3
+    --tls-ciphers           The enabled cipher suites for tls 1.2 and lower (comma separated, for example
+                            TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256)
+    --tls-system-roots      Merge the system root certificates with the CA certificate(s)
+    --tls-insecure-skip-verify
+                            Do not verify the remote certificate, only use this for lab setups!
+    --tls-session-cache     The amount of tls sessions cached for resumption, 0 disables resumption (default 64)
+    --tls-reload-interval   The interval for checking the certificate files for changes, 0 disables it (default 30s)
+    --tls-pin               Pin the public key of the remote, a base64 encoded SHA-256 hash of the public key (SPKI)
+                            optionally prefixed with sha256/ (can be repeated or comma separated for key rotation)
+    --header                Add a header to every request for a http(s) remote, format 'Name: value' (can be repeated)
+    --http-user             The user used for basic authentication on a http(s) remote
+    --http-password-file    The file to read the basic authentication password from
+    --http-password-env     The environment variable to read the basic authentication password from
+    --http-token-file       The file to read the bearer token from for a http(s) remote
+    --http-token-env        The environment variable to read the bearer token from for a http(s) remote
+    --proxy                 Connect to a tcp or http(s) remote through a proxy, the url should have the scheme http (for
+                            a proxy supporting CONNECT) or socks5 and can contain a user (http://user@proxy:3128)
+    --proxy-password-file   The file to read the proxy password from
+    --proxy-password-env    The environment variable to read the proxy password from
+    --resolve-interval      The time the addresses of the remote are cached (default 1m), when expired or when none of
+                            the addresses can be connected the remote is resolved again. All addresses are tried.
+    --write-timeout         The deadline for writing a message to a tcp remote (default 30s, 0 to disable)
+    --conn-max-age          The max lifetime of a connection to a tcp remote before it is replaced (default 0, disabled)
+    --flush-size            The amount of bytes of queued messages that are written at once to a tcp remote (default
+                            65536, 0 will write every message on its own)
+    --flush-delay           The max time to wait for more messages before a write when the flush size is not reached
+                            (default 0, only messages that are already queued are written together)
+    --queue-size            The max amount of queued messages (default 1000), the most severe messages are send first
+                            and when full the least severe messages are dropped. Critical, alert and emergency messages
+                            are never dropped, these will wait for room in the queue.
+    --compress              The compression used for a udp remote, gzip, zlib or none (default gzip)
+    --chunk-size            The max chunk size for a udp remote, lan, wan or a size in bytes (default lan)
 
 Example:
     {{ exec_bin }} listen 127.0.0.1:12201 tcp://example.logger.com:12201
+    {{ exec_bin }} listen -vv --config=/etc/graylog-proxy/config.yaml
 `,
 		},
 	}
@@ -48,65 +172,133 @@ type ListenCommand struct {
 	app.Command
 }
 
+// addListenFlags will add the flags of the listen command that
+// are shared by all listeners and outputs
+func addListenFlags(set *pflag.FlagSet) {
+	set.BoolP("print", "p", false, "")
+	set.Lookup("print").NoOptDefVal = "true"
+	set.String("memory-limit", "256MB", "")
+	set.Int("memory-shed-level", 5, "")
+	set.Duration("heartbeat-interval", 0, "")
+	set.String("log-forward", "", "")
+	set.String("admin-socket", "", "")
+	set.String("status-address", "", "")
+	set.Int("ready-queue-threshold", 90, "")
+	set.Duration("rate-limit-summary", time.Minute, "")
+	set.Duration("drain-timeout", 30*time.Second, "")
+}
+
 func (c *ListenCommand) Init(a *app.App) error {
 	a.Container.(*Container).AddFlags(c.Flags.(*pflag.FlagSet))
-	c.Flags.(*pflag.FlagSet).String("pem", "Client.pem", "")
-	c.Flags.(*pflag.FlagSet).String("crt", "Client.crt", "")
-	c.Flags.(*pflag.FlagSet).String("ca", "CA_Root.crt", "")
-	c.Flags.(*pflag.FlagSet).Bool("new-line", false, "")
-	c.Flags.(*pflag.FlagSet).Lookup("new-line").NoOptDefVal = "true"
-	c.Flags.(*pflag.FlagSet).IntP("workers", "w", 10, "")
-	c.Flags.(*pflag.FlagSet).BoolP("print", "p", false, "")
-	c.Flags.(*pflag.FlagSet).Lookup("print").NoOptDefVal = "true"
-	c.Flags.(*pflag.FlagSet).Bool("no-client-auth", false, "")
-	c.Flags.(*pflag.FlagSet).Lookup("no-client-auth").NoOptDefVal = "true"
+	c.Flags.(*pflag.FlagSet).String("config", "", "")
+	addListenFlags(c.Flags.(*pflag.FlagSet))
+	addListenerFlags(c.Flags.(*pflag.FlagSet))
+	addOutputFlags(c.Flags.(*pflag.FlagSet))
 	return nil
 }
 
-func (c ListenCommand) getIntVar(s string) int {
-	r, _ := c.Flags.(*pflag.FlagSet).GetInt(s)
+func getIntVar(set *pflag.FlagSet, s string) int {
+	r, _ := set.GetInt(s)
 	return r
 }
 
-func (c ListenCommand) getBoolVar(s string) bool {
-	r, _ := c.Flags.(*pflag.FlagSet).GetBool(s)
+func getBoolVar(set *pflag.FlagSet, s string) bool {
+	r, _ := set.GetBool(s)
 	return r
 }
 
-func (c *ListenCommand) print() bool {
-	v, _ := c.Flags.(*pflag.FlagSet).GetBool("print")
-	return v
+// getBudget creates the memory budget from the memory flags
+func getBudget(set *pflag.FlagSet) (*net.Budget, error) {
+	limit, err := net.ParseByteSize(set.Lookup("memory-limit").Value.String())
+	if err != nil {
+		return nil, err
+	}
+	return net.NewBudget(limit, getIntVar(set, "memory-shed-level")), nil
 }
 
-func (c ListenCommand) getFileFromFlag(n string) string {
-	file := c.Flags.(*pflag.FlagSet).Lookup(n).Value.String()
-	if file[0] != '/' {
+// getAccessList creates the access list from the allow and deny
+// flags, nil is returned when no rules are configured
+func getAccessList(set *pflag.FlagSet) (*net.AccessList, error) {
+	var ids = func(name string) []uint32 {
+		values, _ := set.GetUintSlice(name)
+		list := make([]uint32, len(values))
+		for i, value := range values {
+			list[i] = uint32(value)
+		}
+		return list
+	}
+	allow, _ := set.GetStringSlice("allow")
+	deny, _ := set.GetStringSlice("deny")
+	return net.NewAccessList(allow, deny, ids("allow-uid"), ids("allow-gid"))
+}
 
-		cwd := c.Flags.(*pflag.FlagSet).Lookup("cwd").Value.String()
+// getRateLimiter creates the rate limiter from the rate limit flags,
+// nil is returned when no limits are configured
+func getRateLimiter(set *pflag.FlagSet) (*net.RateLimiter, error) {
+	var options = new(net.RateLimitOptions)
+	options.Key, _ = set.GetString("rate-limit-key")
+	if options.Key != "source" && options.Key != "host" && !strings.HasPrefix(options.Key, "_") {
+		return nil, fmt.Errorf("invalid rate limit key '%s', expected source, host or an additional field like _app", options.Key)
+	}
+	options.Messages, _ = set.GetFloat64("rate-limit-messages")
+	options.MessageBurst, _ = set.GetInt("rate-limit-message-burst")
+	bytes, err := net.ParseByteSize(set.Lookup("rate-limit-bytes").Value.String())
+	if err != nil {
+		return nil, err
+	}
+	burst, err := net.ParseByteSize(set.Lookup("rate-limit-byte-burst").Value.String())
+	if err != nil {
+		return nil, err
+	}
+	options.Bytes, options.ByteBurst = float64(bytes), int(burst)
+	return net.NewRateLimiter(options), nil
+}
 
-		if cwd[0] == '~' {
-			file = filepath.Join(os.Getenv("HOME"), cwd[1:], file)
-		} else {
-			file = filepath.Join(c.Flags.(*pflag.FlagSet).Lookup("cwd").Value.String(), file)
-		}
+// getLogForwardLevel returns the log level for the log-forward flag, 0 when disabled
+func getLogForwardLevel(set *pflag.FlagSet) (logger.LogLevel, error) {
+	levels := map[string]func() logger.LogLevel{
+		"emergency": logger.LogLevelEmergency,
+		"alert":     logger.LogLevelAlert,
+		"critical":  logger.LogLevelCritical,
+		"error":     logger.LogLevelError,
+		"warning":   logger.LogLevelWarning,
+		"notice":    logger.LogLevelNotice,
+		"info":      logger.LogLevelInfo,
+		"debug":     logger.LogLevelDebug,
+	}
+	name, _ := set.GetString("log-forward")
+	if name == "" {
+		return 0, nil
 	}
-	return file
+	if level, ok := levels[strings.ToLower(name)]; ok {
+		return level(), nil
+	}
+	return 0, fmt.Errorf("invalid log level '%s', expected emergency, alert, critical, error, warning, notice, info or debug", name)
 }
 
-func (c *ListenCommand) Run(args []string, app *app.App) error {
+// getConfig returns the config from the config file or, when no config
+// file is given, a config with the listener and output of the arguments
+func (c *ListenCommand) getConfig(args []string, container *Container) (*listenConfig, error) {
+	var set = c.Flags.(*pflag.FlagSet)
 
-	isPrint := c.print()
+	if file, _ := set.GetString("config"); file != "" {
+		if len(args) > 0 {
+			return nil, fmt.Errorf("invalid arguments, the addresses are configured in '%s' expected 0 got %d", file, len(args))
+		}
+		return loadListenConfig(resolveFile(set, file), set, container)
+	}
+
+	isPrint := getBoolVar(set, "print")
 
 	if isPrint && (len(args) != 1 && len(args) != 2) {
-		return fmt.Errorf("invalid arguments, expected 1 got %d", len(args))
+		return nil, fmt.Errorf("invalid arguments, expected 1 got %d", len(args))
 	}
 
 	if !isPrint && len(args) != 2 {
-		return fmt.Errorf("invalid arguments, expected 2 got %d", len(args))
+		return nil, fmt.Errorf("invalid arguments, expected 2 got %d", len(args))
 	}
 
 	var local, remote string
-	var conn net.ConnPoolInterface
 
 	local = args[0]
 
@@ -115,80 +307,416 @@ func (c *ListenCommand) Run(args []string, app *app.App) error {
 	}
 
 	if !isPrint && remote == "" {
-		return errors.New("missing remote")
+		return nil, errors.New("missing remote")
 	}
 
 	if strings.Index(local, "://") == -1 {
 		local = "udp://" + local
 	}
 
-	if remote != "" && strings.Index(remote, "://") == -1 {
-		remote = "tcp+ssl://" + remote
+	var config = &listenConfig{
+		flags:     set,
+		listeners: []*configEntry{{name: local, address: local, flags: set}},
+	}
+
+	if remote != "" {
+		if strings.Index(remote, "://") == -1 {
+			remote = "tcp+ssl://" + remote
+		}
+		config.outputs = []*configEntry{{name: remote, address: remote, flags: set}}
+	}
+
+	return config, nil
+}
+
+// reportRateLimits will log the keys that had messages dropped by the rate
+// limiter and sends a GELF message for every key when report is enabled
+func (c *ListenCommand) reportRateLimits(limiter *net.RateLimiter, report bool, outputs []*output, logger *logger.Logger) {
+	hostname, _ := os.Hostname()
+	for _, summary := range limiter.Summary() {
+		logger.Warning(fmt.Sprintf("rate limit exceeded for '%s', dropped %d messages (%d bytes)", summary.Key, summary.Messages, summary.Bytes))
+		if report {
+			message, _ := json.Marshal(map[string]interface{}{
+				"version":              "1.1",
+				"host":                 hostname,
+				"short_message":        fmt.Sprintf("rate limit exceeded for '%s', dropped %d messages", summary.Key, summary.Messages),
+				"level":                4,
+				"_rate_limit_key":      summary.Key,
+				"_rate_limit_messages": summary.Messages,
+				"_rate_limit_bytes":    summary.Bytes,
+			})
+			for _, out := range outputs {
+				out.pushInternal(message)
+			}
+		}
 	}
+}
+
+// heartbeat holds the start time and the counters of the last heartbeat
+// so the amount of messages since the last heartbeat can be reported. The
+// counters of the listeners are kept per listener because the listeners
+// can change on a reload while the heartbeat of an output is kept.
+type heartbeat struct {
+	started   time.Time
+	listeners map[*net.Listener]heartbeatCount
+	forwarded uint64
+	dropped   uint64
+	retried   uint64
+}
 
-	logger := app.Container.(*Container).GetLogger()
+// heartbeatCount holds the received and dropped messages of a listener
+type heartbeatCount struct {
+	received uint64
+	dropped  uint64
+}
 
-	if !isPrint || remote != "" {
-		logger.Debug(fmt.Sprintf("starting forward %s → %s", local, remote))
+// newHeartbeat creates the heartbeat for a new output, the current counters
+// of the listeners are the baseline so only the messages received after the
+// output was started are reported.
+func newHeartbeat(started time.Time, listeners []*input) *heartbeat {
+	beat := &heartbeat{started: started, listeners: make(map[*net.Listener]heartbeatCount)}
+	for _, listener := range listeners {
+		local := listener.State()
+		beat.listeners[listener.Listener] = heartbeatCount{received: local.Received, dropped: local.Dropped + local.Limited}
 	}
+	return beat
+}
 
-	listener, err := net.NewListener(local, logger)
+// sendHeartbeat will send a GELF message with the state of the
+// proxy to the remote so a missing heartbeat can be alerted on
+func (c *ListenCommand) sendHeartbeat(beat *heartbeat, listeners []*input, out *output, version string) {
+	hostname, _ := os.Hostname()
+	remote := out.State()
+	addresses := make([]string, len(listeners))
+	counts := make(map[*net.Listener]heartbeatCount, len(listeners))
+	received, dropped := uint64(0), remote.Discarded-beat.dropped
+	for i, listener := range listeners {
+		local := listener.State()
+		addresses[i] = local.Address
+		// a listener that is not in the last heartbeat is new and started from zero
+		last := beat.listeners[listener.Listener]
+		count := heartbeatCount{received: local.Received, dropped: local.Dropped + local.Limited}
+		received += count.received - last.received
+		dropped += count.dropped - last.dropped
+		counts[listener.Listener] = count
+	}
+	fields := map[string]interface{}{
+		"version":            "1.1",
+		"host":               hostname,
+		"short_message":      fmt.Sprintf("heartbeat, received %d, forwarded %d and dropped %d messages", received, remote.Delivered-beat.forwarded, dropped),
+		"level":              6,
+		"_proxy_event":       "heartbeat",
+		"_proxy_version":     version,
+		"_proxy_uptime":      int64(time.Since(beat.started).Seconds()),
+		"_proxy_listener":    strings.Join(addresses, ","),
+		"_proxy_remote":      remote.Remote,
+		"_proxy_received":    received,
+		"_proxy_forwarded":   remote.Delivered - beat.forwarded,
+		"_proxy_dropped":     dropped,
+		"_proxy_retried":     remote.Retried - beat.retried,
+		"_proxy_queue_depth": remote.Queued,
+	}
+	if pool, ok := out.ConnPoolInterface.(net.CertificateInterface); ok {
+		if certificate := pool.Certificate(); certificate != nil {
+			fields["_proxy_certificate_expiry"] = certificate.NotAfter.Format(time.RFC3339)
+			fields["_proxy_certificate_expires_in"] = int64(time.Until(certificate.NotAfter).Seconds())
+		}
+	}
+	beat.listeners, beat.forwarded, beat.dropped, beat.retried = counts, remote.Delivered, remote.Discarded, remote.Retried
+	message, _ := json.Marshal(fields)
+	out.pushInternal(message)
+}
+
+// serveAdmin will start the admin socket with the commands for controlling the listeners and outputs
+func (c *ListenCommand) serveAdmin(path string, proxy *proxy, tap *net.Tap) (*net.AdminServer, error) {
+	admin, err := net.NewAdminServer(path, proxy.logger)
+	if err != nil {
+		return nil, err
+	}
+	// each applies the function on the active outputs and returns their state
+	var each = func(fn func(pool net.ConnPoolInterface) error) (interface{}, error) {
+		outputs := proxy.pipeline().outputs
+		if len(outputs) == 0 {
+			return nil, errors.New("no remote configured")
+		}
+		states := make([]net.PoolState, len(outputs))
+		for i, out := range outputs {
+			if err := fn(out); err != nil {
+				return nil, err
+			}
+			states[i] = out.State()
+		}
+		return states, nil
+	}
+	admin.Handle("pause", func(args []string) (interface{}, error) {
+		return each(func(pool net.ConnPoolInterface) error {
+			pool.Pause()
+			return nil
+		})
+	})
+	admin.Handle("resume", func(args []string) (interface{}, error) {
+		return each(func(pool net.ConnPoolInterface) error {
+			pool.Resume()
+			return nil
+		})
+	})
+	admin.Handle("flush", func(args []string) (interface{}, error) {
+		timeout := 30 * time.Second
+		if len(args) > 0 {
+			value, err := time.ParseDuration(args[0])
+			if err != nil {
+				return nil, err
+			}
+			timeout = value
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return each(func(pool net.ConnPoolInterface) error {
+			return pool.Flush(ctx)
+		})
+	})
+	admin.Handle("verbosity", func(args []string) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, errors.New("expected one argument, quiet, normal, verbose, very-verbose or debug (or -1 till 3)")
+		}
+		levels := map[string]int{"quiet": -1, "normal": 0, "verbose": 1, "very-verbose": 2, "debug": 3}
+		level, ok := levels[args[0]]
+		if !ok {
+			value, err := strconv.Atoi(args[0])
+			if err != nil || value < -1 || value > 3 {
+				return nil, fmt.Errorf("invalid verbosity '%s'", args[0])
+			}
+			level = value
+		}
+		proxy.container.SetVerboseLevel(level)
+		return args[0], nil
+	})
+	admin.Handle("reload", func(args []string) (interface{}, error) {
+		outputs := proxy.pipeline().outputs
+		if len(outputs) == 0 {
+			return nil, errors.New("no remote configured")
+		}
+		list := reloaders(outputs)
+		if len(list) == 0 {
+			return nil, errors.New("the remote does not use certificates")
+		}
+		for _, reloader := range list {
+			if err := reloader.Reload(); err != nil {
+				return nil, err
+			}
+		}
+		return "reloaded certificates", nil
+	})
+	admin.HandleStream("tail", func(args []string) (net.AdminStreamFunc, error) {
+		filter, err := net.ParseTailFilter(args)
+		if err != nil {
+			return nil, err
+		}
+		return func(send func(interface{}) error, done <-chan struct{}) error {
+			messages, cancel := tap.Subscribe(filter)
+			defer cancel()
+			for {
+				select {
+				case <-done:
+					return nil
+				case message := <-messages:
+					if err := send(message); err != nil {
+						return err
+					}
+				}
+			}
+		}, nil
+	})
+	admin.Handle("state", func(args []string) (interface{}, error) {
+		active := proxy.pipeline()
+		listeners, outputs, budget := active.listeners, active.outputs, proxy.budget
+		state := map[string]interface{}{
+			"listeners": make([]net.ListenerState, len(listeners)),
+			"pools":     make([]net.PoolState, len(outputs)),
+			"memory": map[string]int64{
+				"used":  budget.Used(),
+				"limit": budget.Limit(),
+			},
+		}
+		for i, listener := range listeners {
+			state["listeners"].([]net.ListenerState)[i] = listener.State()
+		}
+		for i, out := range outputs {
+			state["pools"].([]net.PoolState)[i] = out.State()
+		}
+		return state, nil
+	})
+	return admin, nil
+}
+
+func (c *ListenCommand) Run(args []string, app *app.App) error {
+
+	container := app.Container.(*Container)
+	config, err := c.getConfig(args, container)
 
 	if err != nil {
 		return err
 	}
 
-	defer listener.Close()
+	logger := container.GetLogger()
+	budget, err := getBudget(config.flags)
 
-	if remote != "" {
-		host := net.NewGraylogHost(remote)
+	if err != nil {
+		return err
+	}
 
-		if host == nil {
-			return fmt.Errorf("invalid hostname provided, see \"help host\"")
+	for _, out := range config.outputs {
+		for _, listener := range config.listeners {
+			logger.Debug(fmt.Sprintf("starting forward %s → %s", listener.address, out.address))
 		}
+	}
+
+	active, err := newPipeline(config, nil, budget, logger)
+
+	if err != nil {
+		return err
+	}
+
+	var proxy = &proxy{
+		container: container,
+		logger:    logger,
+		budget:    budget,
+		events:    make(chan received),
+		fatal:     make(chan error),
+		stop:      make(chan struct{}),
+		started:   time.Now(),
+		beats:     make(map[*output]*heartbeat),
+	}
 
-		conn, err = net.NewConnPool(
-			c.getBoolVar("no-client-auth"),
-			c.getIntVar("tries"),
-			host,
-			c.getFileFromFlag("ca"),
-			c.getFileFromFlag("crt"),
-			c.getFileFromFlag("pem"),
-			app.Container.(*Container).GetLogger(),
-		)
+	if address, _ := config.flags.GetString("status-address"); address != "" {
+		status, err := net.NewStatusServer(address, logger)
 
 		if err != nil {
 			return err
 		}
-		defer conn.Close()
 
-		workers, _ := c.Flags.(*pflag.FlagSet).GetInt("workers")
-		logger.Debug(fmt.Sprintf("starting conn %d workers", workers))
-		conn.Start(workers)
+		defer status.Close()
+
+		status.QueueThreshold = float64(getIntVar(config.flags, "ready-queue-threshold")) / 100
+		proxy.status = status
+	}
+
+	if err := proxy.start(active); err != nil {
+		return err
 	}
 
-	go listener.Listen()
+	defer proxy.close()
 
-	for ret := range listener.Done {
-		switch val := ret.(type) {
-		case *net.FatalError:
-			return val
-		case error:
-			logger.Error(val)
-		case []byte:
-			id, message := val[:8], val[8:]
-			if isPrint {
-				fmt.Printf("\n#### %X ####\n%s\n##########################\n\n", id, message)
+	var tap *net.Tap
+
+	if path, _ := config.flags.GetString("admin-socket"); path != "" {
+		tap = net.NewTap()
+		admin, err := c.serveAdmin(path, proxy, tap)
+
+		if err != nil {
+			return err
+		}
+
+		defer admin.Close()
+	}
+
+	var summary, beats = new(ticker), new(ticker)
+	var signals = make(chan os.Signal, 1)
+	var file, _ = c.Flags.(*pflag.FlagSet).GetString("config")
+
+	defer summary.Stop()
+	defer beats.Stop()
+
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	for {
+		summary.Reset(config.flags, "rate-limit-summary")
+		beats.Reset(config.flags, "heartbeat-interval")
+
+		select {
+		case err := <-proxy.fatal:
+			return err
+		case <-signals:
+			if file == "" {
+				logger.Notice("received SIGHUP, reloading certificates")
+				for _, reloader := range reloaders(active.outputs) {
+					if err := reloader.Reload(); err != nil {
+						logger.Error(fmt.Sprintf("failed to reload certificates: %s", err.Error()))
+					}
+				}
+				continue
+			}
+			logger.Notice(fmt.Sprintf("received SIGHUP, reloading '%s'", file))
+			if err := proxy.reload(resolveFile(c.Flags.(*pflag.FlagSet), file), c.Flags.(*pflag.FlagSet)); err != nil {
+				logger.Error(fmt.Sprintf("failed to reload the config, keeping the current config: %s", err.Error()))
+				continue
 			}
-			if conn != nil {
-				if c.getBoolVar("new-line") {
-					conn.Push(append(message, '\n'), id)
-				} else {
-					conn.Push(append(message, byte(0)), id)
+			active, config = proxy.pipeline(), proxy.pipeline().config
+			logger.Notice(fmt.Sprintf("reloaded '%s', %d listeners, %d outputs and %d routes", file, len(active.listeners), len(active.outputs), len(config.routes)))
+		case <-summary.C():
+			for _, in := range active.listeners {
+				if in.options.RateLimiter != nil {
+					c.reportRateLimits(in.options.RateLimiter, in.report, active.outputs, logger)
+				}
+			}
+		case <-beats.C():
+			for _, out := range active.outputs {
+				c.sendHeartbeat(proxy.beats[out], active.listeners, out, container.GetVersion())
+			}
+		case event := <-proxy.events:
+			switch val := event.value.(type) {
+			case *net.FatalError:
+				return val
+			case error:
+				logger.Error(val)
+			case []byte:
+				id, message := val[:8], val[8:]
+				tap.Publish(id, message)
+				if getBoolVar(config.flags, "print") {
+					fmt.Printf("\n#### %X ####\n%s\n##########################\n\n", id, message)
+				}
+				pools := active.router.Pools(message)
+				if len(pools) == 0 && len(active.outputs) > 0 {
+					logger.Debug(fmt.Sprintf("[%X] message from '%s' matches no route, dropped", id, event.listener.name))
+				}
+				for _, pool := range pools {
+					pool.(*output).push(message, id)
 				}
 			}
 		}
 	}
+}
 
-	return nil
+// ticker is a time.Ticker that can be enabled, changed or disabled
+// with an interval flag, the channel of a disabled ticker is nil
+type ticker struct {
+	ticker   *time.Ticker
+	interval time.Duration
+}
+
+// Reset will apply the interval of the given flag when it changed
+func (t *ticker) Reset(set *pflag.FlagSet, name string) {
+	interval, _ := set.GetDuration(name)
+	if interval == t.interval {
+		return
+	}
+	t.Stop()
+	if t.interval = interval; interval > 0 {
+		t.ticker = time.NewTicker(interval)
+	}
+}
+
+func (t *ticker) C() <-chan time.Time {
+	if t.ticker == nil {
+		return nil
+	}
+	return t.ticker.C
+}
+
+func (t *ticker) Stop() {
+	if t.ticker != nil {
+		t.ticker.Stop()
+		t.ticker = nil
+	}
 }
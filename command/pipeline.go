@@ -0,0 +1,507 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pbergman/graylog-proxy/net"
+	"github.com/pbergman/logger"
+	"github.com/spf13/pflag"
+)
+
+// input is a listener with the settings of its config entry
+type input struct {
+	*net.Listener
+	name        string
+	fingerprint string
+	options     *net.ListenerOptions
+	report      bool
+}
+
+// output is a started pool with the delimiter for its messages
+type output struct {
+	net.ConnPoolInterface
+	name        string
+	fingerprint string
+	delimiter   byte
+	// removed is closed when the output is removed on a reload
+	removed chan struct{}
+}
+
+// push will add the delimiter to the message and push it to the pool, the
+// message is copied because it can be pushed to more than one output
+func (o *output) push(message []byte, id []byte) {
+	o.Push(append(message[:len(message):len(message)], o.delimiter), id)
+}
+
+// pushInternal will push a message created by the proxy itself (like a
+// heartbeat) so it is not counted as a forwarded message of the output
+func (o *output) pushInternal(message []byte) {
+	o.PushInternal(append(message[:len(message):len(message)], o.delimiter), nil)
+}
+
+// fingerprint returns the address and the values of the given flags, this
+// is compared on a reload to find the listeners and outputs that changed
+func fingerprint(entry *configEntry, names map[string]bool) string {
+	values := []string{entry.address}
+	entry.flags.VisitAll(func(flag *pflag.Flag) {
+		if names[flag.Name] || flag.Name == "cwd" {
+			values = append(values, flag.Name+"="+flag.Value.String())
+		}
+	})
+	return strings.Join(values, "\n")
+}
+
+// getListenerOptions creates the listener options from the listener flags
+func getListenerOptions(set *pflag.FlagSet) (*net.ListenerOptions, error) {
+	var options = new(net.ListenerOptions)
+	var err error
+	if options.RateLimiter, err = getRateLimiter(set); err != nil {
+		return nil, err
+	}
+	if options.AccessList, err = getAccessList(set); err != nil {
+		return nil, err
+	}
+	options.InjectId = getBoolVar(set, "inject-id")
+	return options, nil
+}
+
+// newInput creates the listener for the given config and opens the socket
+func newInput(entry *configEntry, budget *net.Budget, logger *logger.Logger) (*input, error) {
+	listener, err := net.NewListener(entry.address, logger)
+
+	if err != nil {
+		return nil, err
+	}
+
+	in := &input{
+		Listener:    listener,
+		name:        entry.name,
+		fingerprint: fingerprint(entry, flagNames(addListenerFlags)),
+		report:      getBoolVar(entry.flags, "rate-limit-report"),
+	}
+
+	if in.options, err = getListenerOptions(entry.flags); err != nil {
+		return nil, err
+	}
+
+	listener.Budget = budget
+
+	if err := listener.SetOptions(in.options); err != nil {
+		return nil, err
+	}
+
+	if err := listener.Bind(); err != nil {
+		return nil, err
+	}
+
+	return in, nil
+}
+
+// newOutput creates and starts the pool for the given output
+func newOutput(entry *configEntry, budget *net.Budget, logger *logger.Logger) (*output, error) {
+	host := net.NewGraylogHost(entry.address)
+
+	if host == nil {
+		return nil, fmt.Errorf("invalid hostname provided, see \"help host\"")
+	}
+
+	options, err := getConnOptions(entry.flags)
+
+	if err != nil {
+		return nil, err
+	}
+
+	options.Budget = budget
+
+	conn, err := net.NewConnPool(getIntVar(entry.flags, "tries"), host, options, logger)
+
+	if err != nil {
+		return nil, err
+	}
+
+	workers := getIntVar(entry.flags, "workers")
+	logger.Debug(fmt.Sprintf("starting conn %d workers for '%s'", workers, entry.name))
+	conn.Start(workers)
+
+	out := &output{
+		ConnPoolInterface: conn,
+		name:              entry.name,
+		fingerprint:       fingerprint(entry, flagNames(addOutputFlags)),
+		removed:           make(chan struct{}),
+	}
+
+	if getBoolVar(entry.flags, "new-line") {
+		out.delimiter = '\n'
+	}
+
+	return out, nil
+}
+
+// newRouter creates the router for the routes of the config
+func newRouter(config *listenConfig, outputs []*output) *net.Router {
+	var pools = make([]net.ConnPoolInterface, len(outputs))
+	var named = make(map[string]net.ConnPoolInterface)
+	for i, out := range outputs {
+		pools[i], named[out.name] = out, out
+	}
+	var routes = make([]*net.Route, len(config.routes))
+	for i, route := range config.routes {
+		routes[i] = &net.Route{Filter: route.filter, Pools: make([]net.ConnPoolInterface, len(route.outputs))}
+		for j, name := range route.outputs {
+			routes[i].Pools[j] = named[name]
+		}
+	}
+	return net.NewRouter(pools, routes...)
+}
+
+// reloaders returns the outputs that use certificates
+func reloaders(outputs []*output) []net.ReloadInterface {
+	var list []net.ReloadInterface
+	for _, out := range outputs {
+		if reloader, ok := out.ConnPoolInterface.(net.ReloadInterface); ok {
+			list = append(list, reloader)
+		}
+	}
+	return list
+}
+
+// pipeline holds the listeners, outputs and router of a config
+type pipeline struct {
+	config    *listenConfig
+	listeners []*input
+	outputs   []*output
+	router    *net.Router
+}
+
+func (p *pipeline) input(name string) *input {
+	if p != nil {
+		for _, in := range p.listeners {
+			if in.name == name {
+				return in
+			}
+		}
+	}
+	return nil
+}
+
+func (p *pipeline) output(name string) *output {
+	if p != nil {
+		for _, out := range p.outputs {
+			if out.name == name {
+				return out
+			}
+		}
+	}
+	return nil
+}
+
+// has returns true when the pipeline uses the given listener or output
+func (p *pipeline) has(v interface{}) bool {
+	if p == nil {
+		return false
+	}
+	for _, in := range p.listeners {
+		if in == v || in.Listener == v {
+			return true
+		}
+	}
+	for _, out := range p.outputs {
+		if out == v {
+			return true
+		}
+	}
+	return false
+}
+
+// discard will close the listeners and outputs that are not part of the
+// current pipeline, this is used when the pipeline could not be started
+func (p *pipeline) discard(current *pipeline) {
+	for _, in := range p.listeners {
+		if !current.has(in.Listener) {
+			in.Close()
+		}
+	}
+	for _, out := range p.outputs {
+		if !current.has(out) {
+			out.Close()
+		}
+	}
+}
+
+// newPipeline creates the listeners and outputs of the config. The listeners
+// and outputs of the current pipeline (when given) that did not change are
+// taken over, a listener of which only the options changed keeps its socket
+// and gets the new options when the pipeline is started. On error the
+// listeners and outputs that were created are closed again.
+func newPipeline(config *listenConfig, current *pipeline, budget *net.Budget, logger *logger.Logger) (_ *pipeline, err error) {
+	p := &pipeline{config: config}
+
+	defer func() {
+		if err != nil {
+			p.discard(current)
+		}
+	}()
+
+	for _, entry := range config.listeners {
+		in := current.input(entry.name)
+		switch {
+		case in == nil:
+			if in, err = newInput(entry, budget, logger); err != nil {
+				return nil, fmt.Errorf("listener '%s': %s", entry.name, err.Error())
+			}
+		case in.fingerprint != fingerprint(entry, flagNames(addListenerFlags)):
+			options, err := getListenerOptions(entry.flags)
+			if err != nil {
+				return nil, fmt.Errorf("listener '%s': %s", entry.name, err.Error())
+			}
+			in = &input{
+				Listener:    in.Listener,
+				name:        entry.name,
+				fingerprint: fingerprint(entry, flagNames(addListenerFlags)),
+				options:     options,
+				report:      getBoolVar(entry.flags, "rate-limit-report"),
+			}
+		}
+		p.listeners = append(p.listeners, in)
+	}
+
+	for _, entry := range config.outputs {
+		out := current.output(entry.name)
+		if out == nil || out.fingerprint != fingerprint(entry, flagNames(addOutputFlags)) {
+			if out, err = newOutput(entry, budget, logger); err != nil {
+				return nil, fmt.Errorf("output '%s': %s", entry.name, err.Error())
+			}
+		}
+		p.outputs = append(p.outputs, out)
+	}
+
+	p.router = newRouter(config, p.outputs)
+
+	return p, nil
+}
+
+// received is a value from the Done channel of a listener
+type received struct {
+	listener *input
+	value    interface{}
+}
+
+// proxy runs the active pipeline, on a reload of the config the new
+// pipeline is started and swapped in before the parts of the old
+// pipeline that are not used anymore are stopped
+type proxy struct {
+	container *Container
+	logger    *logger.Logger
+	budget    *net.Budget
+	status    *net.StatusServer
+	active    atomic.Value
+	events    chan received
+	fatal     chan error
+	stop      chan struct{}
+	started   time.Time
+	beats     map[*output]*heartbeat
+}
+
+// pipeline returns the active pipeline
+func (p *proxy) pipeline() *pipeline {
+	active, _ := p.active.Load().(*pipeline)
+	return active
+}
+
+// forward will pass the values of the listener to the events channel till
+// the listener is closed, after a stop the values are read and ignored so
+// the listener can be closed
+func (p *proxy) forward(in *input) {
+	for value := range in.Done {
+		select {
+		case p.events <- received{in, value}:
+		case <-p.stop:
+		}
+	}
+}
+
+// watch will pass the fatal error of the output till it is removed
+func (p *proxy) watch(out *output) {
+	select {
+	case err := <-out.Fatal():
+		select {
+		case p.fatal <- err:
+		case <-p.stop:
+		}
+	case <-out.removed:
+	case <-p.stop:
+	}
+}
+
+// start will start the listeners and outputs of the next pipeline that
+// are not part of the active pipeline and makes it the active pipeline.
+// Nothing is started till the pipeline is validated, on error the active
+// pipeline is kept and the listeners and outputs that are not part of it
+// are closed.
+func (p *proxy) start(next *pipeline) (err error) {
+	current := p.pipeline()
+
+	defer func() {
+		if err != nil {
+			if current != nil {
+				for _, in := range current.listeners {
+					in.SetOptions(in.options)
+				}
+			}
+			next.discard(current)
+		}
+	}()
+
+	level, err := getLogForwardLevel(next.config.flags)
+
+	if err != nil {
+		return err
+	}
+
+	// the options of a kept listener can need the peer credentials
+	// which are enabled on the socket when the options are set
+	for _, in := range next.listeners {
+		if err := in.SetOptions(in.options); err != nil {
+			return fmt.Errorf("listener '%s': %s", in.name, err.Error())
+		}
+	}
+
+	for _, in := range next.listeners {
+		if !current.has(in.Listener) {
+			p.logger.Debug(fmt.Sprintf("starting listener '%s'", in.name))
+			go in.Listen()
+			go p.forward(in)
+			if p.status != nil {
+				p.status.AddListener(in.Listener)
+			}
+		}
+	}
+
+	for _, out := range next.outputs {
+		if !current.has(out) {
+			go p.watch(out)
+			p.beats[out] = newHeartbeat(p.started, next.listeners)
+			if p.status != nil {
+				p.status.AddPool(out)
+			}
+		}
+	}
+
+	if len(next.outputs) > 0 && (level != 0 || current != nil) {
+		p.container.GetLogHandler().Forward(next.outputs[0].ConnPoolInterface, level, next.outputs[0].delimiter)
+	}
+
+	p.active.Store(next)
+
+	return nil
+}
+
+// remove will stop the listeners and outputs of the old pipeline that are
+// not part of the active pipeline, the queue of a removed output is drained
+// before it is closed
+func (p *proxy) remove(old *pipeline) {
+	active := p.pipeline()
+	timeout, _ := active.config.flags.GetDuration("drain-timeout")
+
+	for _, in := range old.listeners {
+		if !active.has(in.Listener) {
+			p.logger.Notice(fmt.Sprintf("closing listener '%s'", in.name))
+			if p.status != nil {
+				p.status.RemoveListener(in.Listener)
+			}
+			// the values that are still parsed are forwarded
+			// so the close is done without blocking the events
+			go in.Close()
+		}
+	}
+
+	for _, out := range old.outputs {
+		if !active.has(out) {
+			close(out.removed)
+			delete(p.beats, out)
+			if p.status != nil {
+				p.status.RemovePool(out)
+			}
+			go p.drain(out, timeout)
+		}
+	}
+}
+
+// drain will deliver the queued messages of the output before it is closed
+func (p *proxy) drain(out *output, timeout time.Duration) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	p.logger.Notice(fmt.Sprintf("draining output '%s', %d messages queued", out.name, out.State().Queued))
+	if err := out.Drain(ctx); err != nil {
+		p.logger.Warning(fmt.Sprintf("closing output '%s' with %d messages queued: %s", out.name, out.State().Queued, err.Error()))
+	} else {
+		p.logger.Notice(fmt.Sprintf("closing output '%s', all messages delivered", out.name))
+	}
+	out.Close()
+}
+
+// restartFlags are the options that are only applied on a restart
+var restartFlags = []string{"memory-limit", "memory-shed-level", "admin-socket", "status-address", "ready-queue-threshold"}
+
+// reload will read the config file and swaps the active pipeline for the
+// new pipeline, on error the active pipeline is kept
+func (p *proxy) reload(file string, cli *pflag.FlagSet) error {
+	config, err := loadListenConfig(file, cli, p.container)
+
+	if err != nil {
+		return err
+	}
+
+	current := p.pipeline()
+
+	for _, name := range restartFlags {
+		if value := config.flags.Lookup(name).Value.String(); value != current.config.flags.Lookup(name).Value.String() {
+			p.logger.Warning(fmt.Sprintf("the option '%s' changed to '%s', this is applied on a restart", name, value))
+		}
+	}
+
+	next, err := newPipeline(config, current, p.budget, p.logger)
+
+	if err != nil {
+		return err
+	}
+
+	if err := p.start(next); err != nil {
+		return err
+	}
+
+	p.remove(current)
+
+	// the certificates of the outputs that are kept are reloaded
+	// as well, the new outputs have loaded their certificates
+	for _, out := range next.outputs {
+		if reloader, ok := out.ConnPoolInterface.(net.ReloadInterface); ok && current.has(out) {
+			if err := reloader.Reload(); err != nil {
+				p.logger.Error(fmt.Sprintf("failed to reload certificates of '%s': %s", out.name, err.Error()))
+			}
+		}
+	}
+
+	return nil
+}
+
+// close will stop the listeners and close the outputs of the active pipeline
+func (p *proxy) close() {
+	close(p.stop)
+	if active := p.pipeline(); active != nil {
+		for _, in := range active.listeners {
+			in.Close()
+		}
+		for _, out := range active.outputs {
+			out.Close()
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	stdnet "net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pbergman/graylog-proxy/net"
+	"github.com/pbergman/logger"
+)
+
+// freeAddress returns a local udp address that is not in use
+func freeAddress(t *testing.T) string {
+	conn, err := stdnet.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+// testSink opens a udp socket that receives the messages of an output
+func testSink(t *testing.T) stdnet.PacketConn {
+	conn, err := stdnet.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// sendMessage will send a GELF message to the listener on the given address
+func sendMessage(t *testing.T, address string, message string) {
+	conn, err := stdnet.Dial("udp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(message)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitFor will wait till the condition is true
+func waitFor(t *testing.T, what string, condition func() bool) {
+	for i := 0; !condition(); i++ {
+		if i == 200 {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newTestProxy() *proxy {
+	log := logger.NewLogger("test")
+	return &proxy{
+		container: &Container{logger: log, gelf: net.NewGelfLogHandler()},
+		logger:    log,
+		events:    make(chan received),
+		fatal:     make(chan error),
+		stop:      make(chan struct{}),
+		started:   time.Now(),
+		beats:     make(map[*output]*heartbeat),
+	}
+}
+
+func TestProxy_reload(t *testing.T) {
+	a, b := freeAddress(t), freeAddress(t)
+	one, two := testSink(t), testSink(t)
+	config := func(listeners, outputs string) string {
+		return fmt.Sprintf("compress: none\ndrain-timeout: 5s\nlisteners:\n%s\noutputs:\n%s\n", listeners, outputs)
+	}
+	outputs := fmt.Sprintf("  - {name: one, address: \"udp://%s\"}", one.LocalAddr())
+	loaded, _, err := testConfig(t, config(
+		fmt.Sprintf("  - address: \"%s\"\n  - address: \"%s\"", a, b),
+		outputs+fmt.Sprintf("\n  - {name: two, address: \"udp://%s\"}", two.LocalAddr()),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := newTestProxy()
+	defer proxy.close()
+	first, err := newPipeline(loaded, nil, nil, proxy.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := proxy.start(first); err != nil {
+		t.Fatal(err)
+	}
+	// the queued messages of a removed output are delivered
+	removed := first.output("two")
+	removed.Pause()
+	removed.push([]byte(`{"short_message":"queued"}`), nil)
+	cli := newListenFlagSet(proxy.container)
+	file := writeConfig(t, config(
+		fmt.Sprintf("  - address: \"%s\"\n  - address: \"%s\"\n    deny: 127.0.0.1/32", a, b),
+		outputs,
+	))
+	if err := proxy.reload(file, cli); err != nil {
+		t.Fatal(err)
+	}
+	second := proxy.pipeline()
+	if second == first || second.input("udp://"+a) != first.input("udp://"+a) || second.output("one") != first.output("one") {
+		t.Fatal("expected the unchanged listener and output to be kept")
+	}
+	changed := second.input("udp://" + b)
+	if changed == first.input("udp://"+b) || changed.Listener != first.input("udp://"+b).Listener {
+		t.Fatal("expected the changed listener to keep its socket")
+	}
+	if changed.Options() != changed.options {
+		t.Fatal("expected the changed listener to get the new options")
+	}
+	sendMessage(t, b, `{"short_message":"denied"}`)
+	waitFor(t, "the message to be rejected", func() bool { return changed.State().Rejected == 1 })
+	if second.output("two") != nil || proxy.beats[removed] != nil {
+		t.Fatal("expected the output to be removed")
+	}
+	select {
+	case <-removed.removed:
+	default:
+		t.Fatal("expected the removed channel to be closed")
+	}
+	for _, pool := range second.router.Pools([]byte(`{"short_message":"new"}`)) {
+		if pool == removed {
+			t.Fatal("expected the removed output to get no new messages")
+		}
+	}
+	buf := make([]byte, 1024)
+	two.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, _, err := two.ReadFrom(buf); err != nil || !strings.Contains(string(buf[:n]), "queued") {
+		t.Fatalf("expected the queued message to be delivered, got '%s' (%v)", buf[:n], err)
+	}
+	// a config that fails the validation keeps the active pipeline
+	for _, invalid := range []string{
+		config(fmt.Sprintf("  - address: \"%s\"", a), outputs+"\nroutes:\n  - outputs: [two]"),
+		config(fmt.Sprintf("  - address: \"%s\"\n  - address: \"%s\"", a, one.LocalAddr()), outputs),
+	} {
+		if err := proxy.reload(writeConfig(t, invalid), cli); err == nil {
+			t.Fatalf("expected the reload of\n%s\nto fail", invalid)
+		}
+		if proxy.pipeline() != second {
+			t.Fatal("expected the active pipeline to be kept")
+		}
+	}
+	sendMessage(t, a, `{"short_message":"kept"}`)
+	select {
+	case event := <-proxy.events:
+		if event.listener != second.input("udp://"+a) {
+			t.Fatalf("expected the message from '%s' got '%s'", a, event.listener.name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the kept listener to receive the message")
+	}
+}
+
+// heartbeatPool is a pool that keeps the internal messages
+type heartbeatPool struct {
+	net.ConnPoolInterface
+	messages [][]byte
+}
+
+func (h *heartbeatPool) State() net.PoolState {
+	return net.PoolState{Remote: "test"}
+}
+
+func (h *heartbeatPool) PushInternal(data []byte, id []byte) *net.ConnQueueItem {
+	h.messages = append(h.messages, data)
+	return nil
+}
+
+func TestListenCommand_sendHeartbeat(t *testing.T) {
+	addresses := []string{freeAddress(t), freeAddress(t), freeAddress(t)}
+	loaded, _, err := testConfig(t, fmt.Sprintf("print: true\nlisteners:\n  - address: \"%s\"\n  - address: \"%s\"\n  - address: \"%s\"", addresses[0], addresses[1], addresses[2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var inputs []*input
+	for _, entry := range loaded.listeners {
+		in, err := newInput(entry, nil, logger.NewLogger("test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer in.Close()
+		go in.Listen()
+		go func() {
+			for range in.Done {
+			}
+		}()
+		inputs = append(inputs, in)
+	}
+	send := func(i int, count int) {
+		expected := inputs[i].State().Received + uint64(count)
+		for j := 0; j < count; j++ {
+			sendMessage(t, addresses[i], `{"short_message":"test"}`)
+		}
+		waitFor(t, "the messages to be received", func() bool { return inputs[i].State().Received == expected })
+	}
+	pool := new(heartbeatPool)
+	out := &output{ConnPoolInterface: pool}
+	send(0, 3)
+	send(1, 2)
+	// a new output only reports the messages received after it was started
+	heartbeat := newHeartbeat(time.Now(), inputs[:2])
+	beat := func(listeners ...*input) float64 {
+		var fields map[string]interface{}
+		new(ListenCommand).sendHeartbeat(heartbeat, listeners, out, "test")
+		message := pool.messages[len(pool.messages)-1]
+		if err := json.Unmarshal(message[:len(message)-1], &fields); err != nil {
+			t.Fatal(err)
+		}
+		return fields["_proxy_received"].(float64)
+	}
+	send(0, 1)
+	if received := beat(inputs[:2]...); received != 1 {
+		t.Fatalf("expected 1 received message got %v", received)
+	}
+	// a removed listener is not reported and a new listener started from zero
+	send(0, 1)
+	send(2, 2)
+	if received := beat(inputs[0], inputs[2]); received != 3 {
+		t.Fatalf("expected 3 received messages got %v", received)
+	}
+}
+
+func TestProxy_start(t *testing.T) {
+	a, b := freeAddress(t), freeAddress(t)
+	one, two := testSink(t), testSink(t)
+	config := "listeners:\n  - address: \"%s\"\n%soutputs:\n  - {name: one, address: \"udp://%s\"}\n%s"
+	loaded, _, err := testConfig(t, fmt.Sprintf(config, a, "", one.LocalAddr(), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := newTestProxy()
+	defer proxy.close()
+	first, err := newPipeline(loaded, nil, nil, proxy.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := proxy.start(first); err != nil {
+		t.Fatal(err)
+	}
+	loaded, _, err = testConfig(t, fmt.Sprintf(config, a, "    deny: 127.0.0.1/32\n  - address: \""+b+"\"\n", one.LocalAddr(), "  - {name: two, address: \"udp://"+two.LocalAddr().String()+"\"}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := newPipeline(loaded, first, nil, proxy.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an invalid pipeline is not started and the new parts are closed
+	next.config.flags.Set("log-forward", "invalid")
+	if err := proxy.start(next); err == nil {
+		t.Fatal("expected an invalid log forward level to fail")
+	}
+	if proxy.pipeline() != first || first.input("udp://"+a).Options() != first.input("udp://"+a).options {
+		t.Fatal("expected the active pipeline to be kept")
+	}
+	if next.input("udp://"+b).State().Bound || proxy.beats[next.output("two")] != nil {
+		t.Fatal("expected the new listener to be closed and the new output not to be started")
+	}
+	if item := next.output("two").Push([]byte(`{"short_message":"closed"}`), nil); !item.HasError() {
+		t.Fatal("expected the new output to be closed")
+	}
+}
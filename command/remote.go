@@ -0,0 +1,192 @@
+package command
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pbergman/graylog-proxy/net"
+	"github.com/spf13/pflag"
+)
+
+// addRemoteFlags will add the flags that are shared between the
+// commands that connect to a remote (listen, debug:client)
+func addRemoteFlags(set *pflag.FlagSet) {
+	set.String("pem", "Client.pem", "")
+	set.String("crt", "Client.crt", "")
+	set.String("ca", "CA_Root.crt", "")
+	set.Bool("no-client-auth", false, "")
+	set.Lookup("no-client-auth").NoOptDefVal = "true"
+	set.String("tls-server-name", "", "")
+	set.String("tls-min-version", "", "")
+	set.StringSlice("tls-ciphers", nil, "")
+	set.Bool("tls-system-roots", false, "")
+	set.Lookup("tls-system-roots").NoOptDefVal = "true"
+	set.Bool("tls-insecure-skip-verify", false, "")
+	set.Lookup("tls-insecure-skip-verify").NoOptDefVal = "true"
+	set.Int("tls-session-cache", 64, "")
+	set.Duration("tls-reload-interval", 30*time.Second, "")
+	set.StringSlice("tls-pin", nil, "")
+	set.StringArray("header", nil, "")
+	set.String("http-user", "", "")
+	set.String("http-password-file", "", "")
+	set.String("http-password-env", "", "")
+	set.String("http-token-file", "", "")
+	set.String("http-token-env", "", "")
+	set.String("proxy", "", "")
+	set.String("proxy-password-file", "", "")
+	set.String("proxy-password-env", "", "")
+	set.Duration("resolve-interval", time.Minute, "")
+	set.Duration("write-timeout", 30*time.Second, "")
+	set.Duration("conn-max-age", 0, "")
+	set.Int("flush-size", 64*1024, "")
+	set.Duration("flush-delay", 0, "")
+	set.Int("queue-size", 1000, "")
+	set.String("compress", "gzip", "")
+	set.String("chunk-size", "lan", "")
+}
+
+// resolveFile will prefix the cwd value to none absolute file locations
+func resolveFile(set *pflag.FlagSet, file string) string {
+	if len(file) > 0 && file[0] != '/' {
+		cwd := set.Lookup("cwd").Value.String()
+		if len(cwd) > 0 && cwd[0] == '~' {
+			return filepath.Join(os.Getenv("HOME"), cwd[1:], file)
+		}
+		return filepath.Join(cwd, file)
+	}
+	return file
+}
+
+// getSecret will read a secret from the file or environment variable
+// flag, when both are empty it will return an empty secret.
+func getSecret(set *pflag.FlagSet, name string) (net.Secret, error) {
+	file, _ := set.GetString(name + "-file")
+	env, _ := set.GetString(name + "-env")
+	switch {
+	case file != "" && env != "":
+		return "", fmt.Errorf("the flags --%s-file and --%s-env can not be used together", name, name)
+	case file != "":
+		return net.ReadSecretFile(resolveFile(set, file))
+	case env != "":
+		return net.ReadSecretEnv(env)
+	default:
+		return "", nil
+	}
+}
+
+// getChunkSize will return the chunk size for the given
+// value that can be a size or one of the presets lan/wan
+func getChunkSize(value string) (int, error) {
+	switch strings.ToLower(value) {
+	case "lan":
+		return net.ChunkSizeLan, nil
+	case "wan":
+		return net.ChunkSizeWan, nil
+	default:
+		size, err := strconv.Atoi(value)
+		if err != nil || size <= 0 {
+			return 0, fmt.Errorf("invalid chunk size '%s', expected lan, wan or a positive number", value)
+		}
+		return size, nil
+	}
+}
+
+// getTlsOptions will create the tls options based on the remote flags
+func getTlsOptions(set *pflag.FlagSet) (options net.TlsOptions, err error) {
+	options.CA = resolveFile(set, set.Lookup("ca").Value.String())
+	options.Crt = resolveFile(set, set.Lookup("crt").Value.String())
+	options.Pem = resolveFile(set, set.Lookup("pem").Value.String())
+	options.NoClientAuth, _ = set.GetBool("no-client-auth")
+	options.ServerName, _ = set.GetString("tls-server-name")
+	options.SystemRoots, _ = set.GetBool("tls-system-roots")
+	options.InsecureSkipVerify, _ = set.GetBool("tls-insecure-skip-verify")
+	options.SessionCacheSize, _ = set.GetInt("tls-session-cache")
+	options.ReloadInterval, _ = set.GetDuration("tls-reload-interval")
+	options.Pins, _ = set.GetStringSlice("tls-pin")
+	if options.MinVersion, err = net.ParseTlsVersion(set.Lookup("tls-min-version").Value.String()); err != nil {
+		return
+	}
+	ciphers, _ := set.GetStringSlice("tls-ciphers")
+	options.CipherSuites, err = net.ParseCipherSuites(ciphers)
+	return
+}
+
+// getProxy will return the proxy url from the proxy flags,
+// nil is returned when no proxy is configured
+func getProxy(set *pflag.FlagSet) (*url.URL, error) {
+	raw, _ := set.GetString("proxy")
+	if raw == "" {
+		return nil, nil
+	}
+	proxy, err := net.NewProxyUrl(raw)
+	if err != nil {
+		return nil, err
+	}
+	password, err := getSecret(set, "proxy-password")
+	if err != nil {
+		return nil, err
+	}
+	if password != "" {
+		if proxy.User == nil {
+			return nil, fmt.Errorf("a proxy password is provided but the proxy url has no user")
+		}
+		proxy.User = url.UserPassword(proxy.User.Username(), string(password))
+	}
+	return proxy, nil
+}
+
+// getConnOptions will create the remote options based on the remote flags
+func getConnOptions(set *pflag.FlagSet) (*net.ConnOptions, error) {
+	options := new(net.ConnOptions)
+	headers, _ := set.GetStringArray("header")
+	for _, header := range headers {
+		index := strings.Index(header, ":")
+		if index <= 0 {
+			return nil, fmt.Errorf("invalid header '%s', expected format 'Name: value'", header)
+		}
+		if options.Header == nil {
+			options.Header = make(http.Header)
+		}
+		options.Header.Add(strings.TrimSpace(header[:index]), strings.TrimSpace(header[index+1:]))
+	}
+	user, _ := set.GetString("http-user")
+	password, err := getSecret(set, "http-password")
+	if err != nil {
+		return nil, err
+	}
+	token, err := getSecret(set, "http-token")
+	if err != nil {
+		return nil, err
+	}
+	if token != "" && user != "" {
+		return nil, fmt.Errorf("the flags --http-token-* and --http-user can not be used together")
+	}
+	if token != "" || user != "" {
+		options.Auth = &net.HttpAuth{User: user, Password: password, Token: token}
+	}
+	if options.Compression, err = net.NewCompression(set.Lookup("compress").Value.String()); err != nil {
+		return nil, err
+	}
+	if options.ChunkSize, err = getChunkSize(set.Lookup("chunk-size").Value.String()); err != nil {
+		return nil, err
+	}
+	if options.Tls, err = getTlsOptions(set); err != nil {
+		return nil, err
+	}
+	if options.Proxy, err = getProxy(set); err != nil {
+		return nil, err
+	}
+	options.ResolveInterval, _ = set.GetDuration("resolve-interval")
+	options.WriteTimeout, _ = set.GetDuration("write-timeout")
+	options.MaxAge, _ = set.GetDuration("conn-max-age")
+	options.FlushSize, _ = set.GetInt("flush-size")
+	options.FlushDelay, _ = set.GetDuration("flush-delay")
+	options.QueueSize, _ = set.GetInt("queue-size")
+	return options, nil
+}
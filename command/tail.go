@@ -0,0 +1,101 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pbergman/app"
+	"github.com/pbergman/graylog-proxy/net"
+	"github.com/spf13/pflag"
+)
+
+func NewTailCommand() app.CommandInterface {
+	return &TailCommand{
+		app.Command{
+			Flags: new(pflag.FlagSet),
+			Name:  "tail",
+			Usage: "[options]",
+			Short: "Follow the messages of a running listen process",
+			Long: `The tail command attaches to the admin socket of a running listen process (see the admin-socket flag of the listen
+command) and prints the received messages, after they are decompressed and reassembled, with their proxy id till it is
+interrupted. The filters are applied by the listen process so only the matching messages are send.
+
+When the tail command can not keep up with the received messages, messages are skipped (and reported) so the delivery
+of the messages is never slowed down.
+
+Options:
+    --quiet                 Disable the application output
+    --verbose (-v,-vv,-vvv) Increase the verbosity of application output
+    --log-format            The format of the application output, text or json with one object per line (default text)
+    --socket (-s)           The path of the admin socket (default ./graylog-proxy.sock)
+    --level (-l)            Only print messages with this level or more severe (0 till 7)
+    --host                  Only print messages with a host matching this pattern (like web-*)
+    --field (-f)            Only print messages with a field matching the pattern, format 'name=pattern' like _app=api
+                            (can be repeated, all fields should match)
+    --pretty                Print the messages indented
+
+Example:
+    {{ exec_bin }} tail --socket=/run/graylog-proxy.sock --level=3 --field=_app=api
+`,
+		},
+	}
+}
+
+type TailCommand struct {
+	app.Command
+}
+
+func (c *TailCommand) Init(a *app.App) error {
+	a.Container.(*Container).AddFlags(c.Flags.(*pflag.FlagSet))
+	c.Flags.(*pflag.FlagSet).StringP("socket", "s", "./graylog-proxy.sock", "")
+	c.Flags.(*pflag.FlagSet).IntP("level", "l", -1, "")
+	c.Flags.(*pflag.FlagSet).String("host", "", "")
+	c.Flags.(*pflag.FlagSet).StringArrayP("field", "f", nil, "")
+	c.Flags.(*pflag.FlagSet).Bool("pretty", false, "")
+	c.Flags.(*pflag.FlagSet).Lookup("pretty").NoOptDefVal = "true"
+	return nil
+}
+
+// getFilter creates the filter from the level, host and field flags
+func (c *TailCommand) getFilter() (*net.TailFilter, error) {
+	var set = c.Flags.(*pflag.FlagSet)
+	var args []string
+	if level, _ := set.GetInt("level"); level >= 0 {
+		args = append(args, fmt.Sprintf("level=%d", level))
+	}
+	if host, _ := set.GetString("host"); host != "" {
+		args = append(args, "host="+host)
+	}
+	fields, _ := set.GetStringArray("field")
+	return net.ParseTailFilter(append(args, fields...))
+}
+
+func (c *TailCommand) Run(args []string, app *app.App) error {
+	if len(args) > 0 {
+		return fmt.Errorf("invalid arguments, expected 0 got %d", len(args))
+	}
+	filter, err := c.getFilter()
+	if err != nil {
+		return err
+	}
+	socket, _ := c.Flags.(*pflag.FlagSet).GetString("socket")
+	pretty, _ := c.Flags.(*pflag.FlagSet).GetBool("pretty")
+	logger := app.Container.(*Container).GetLogger()
+	return net.AdminStream(socket, "tail", filter.Args(), func(raw json.RawMessage) error {
+		var message net.TailMessage
+		if err := json.Unmarshal(raw, &message); err != nil {
+			return err
+		}
+		if message.Dropped > 0 {
+			logger.Warning(fmt.Sprintf("skipped %d messages", message.Dropped))
+		}
+		out := []byte(message.Message)
+		if pretty {
+			if indented, err := json.MarshalIndent(message.Message, "", "    "); err == nil {
+				out = indented
+			}
+		}
+		fmt.Printf("[%s] %s\n", message.Id, out)
+		return nil
+	})
+}
@@ -7,6 +7,7 @@ require (
 	github.com/pbergman/logger v0.0.0-20201006115342-450d3ca9757c
 	github.com/spf13/pflag v1.0.5
 	golang.org/x/crypto v0.3.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
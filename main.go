@@ -7,11 +7,23 @@ import (
 	"github.com/pbergman/graylog-proxy/command"
 )
 
+// version and ref are set on build (see makefile)
+var (
+	version string
+	ref     string
+)
+
 func main() {
 
 	container := new(command.Container)
 	container.SetApp(newApp(container))
 
+	if version != "" && ref != "" {
+		container.SetVersion(version + "-" + ref)
+	} else {
+		container.SetVersion(version)
+	}
+
 	// catch no args
 	if len(container.GetArgs()) < 1 {
 		container.GetFlags().Usage()
@@ -31,6 +43,9 @@ func newApp(c *command.Container) *app.App {
 		command.NewCreateClientCommand(),
 		command.NewDebugClientCommand(),
 		command.NewListenCommand(),
+		command.NewConfigCheckCommand(),
+		command.NewCtlCommand(),
+		command.NewTailCommand(),
 		command.NewDnCommand(),
 		command.NewHostCommand(),
 	)
@@ -0,0 +1,137 @@
+package net
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// peerCredentials holds the credentials of the process
+// that send a message on a unix socket
+type peerCredentials struct {
+	Pid int32
+	Uid uint32
+	Gid uint32
+}
+
+// AccessList decides which sources can send messages to a listener.
+//
+// The source address of a packet is checked against the deny list first
+// and then against the allow list, an empty allow list allows all. For
+// unix sockets the peer credentials are checked against the allowed uids
+// and gids, these are only available on linux.
+type AccessList struct {
+	allow    []*net.IPNet
+	deny     []*net.IPNet
+	uids     []uint32
+	gids     []uint32
+	rejected uint64
+}
+
+// credentials returns true when the peer credentials are needed
+func (a *AccessList) credentials() bool {
+	return a != nil && (len(a.uids) > 0 || len(a.gids) > 0)
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsId(ids []uint32, id uint32) bool {
+	for _, value := range ids {
+		if value == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *AccessList) allowed(address net.Addr, peer *peerCredentials) bool {
+	var ip net.IP
+	switch address := address.(type) {
+	case *net.UDPAddr:
+		ip = address.IP
+	case *net.IPAddr:
+		ip = address.IP
+	case *net.UnixAddr, nil:
+		if !a.credentials() {
+			return true
+		}
+		return peer != nil && (containsId(a.uids, peer.Uid) || containsId(a.gids, peer.Gid))
+	}
+	if ip == nil || containsIP(a.deny, ip) {
+		return false
+	}
+	return len(a.allow) == 0 || containsIP(a.allow, ip)
+}
+
+// Allowed returns true when a packet from the given address (and peer
+// credentials for unix sockets) is allowed, rejected packets are counted.
+func (a *AccessList) Allowed(address net.Addr, peer *peerCredentials) bool {
+	if a == nil {
+		return true
+	}
+	if a.allowed(address, peer) {
+		return true
+	}
+	atomic.AddUint64(&a.rejected, 1)
+	return false
+}
+
+// Rejected returns the amount of rejected packets
+func (a *AccessList) Rejected() uint64 {
+	if a == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&a.rejected)
+}
+
+// parseNetworks will parse the given CIDR notations, a
+// single address is handled as a network of that address.
+func parseNetworks(values []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, value := range values {
+		if strings.Index(value, "/") == -1 {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, errors.New("invalid address '" + value + "'")
+			}
+			size := 8 * len(ip)
+			if ip.To4() != nil {
+				ip, size = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(size, size)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network '%s': %s", value, err.Error())
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// NewAccessList creates an access list for the given networks (CIDR
+// notation) and ids, nil is returned when no rules are given.
+func NewAccessList(allow, deny []string, uids, gids []uint32) (*AccessList, error) {
+	if len(allow) == 0 && len(deny) == 0 && len(uids) == 0 && len(gids) == 0 {
+		return nil, nil
+	}
+	var list = &AccessList{uids: uids, gids: gids}
+	var err error
+	if list.allow, err = parseNetworks(allow); err != nil {
+		return nil, err
+	}
+	if list.deny, err = parseNetworks(deny); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
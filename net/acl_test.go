@@ -0,0 +1,64 @@
+package net
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestAccessList_Allowed(t *testing.T) {
+	list, err := NewAccessList([]string{"172.17.0.0/16", "::1"}, []string{"172.17.0.1"}, []uint32{1000}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for address, expected := range map[string]bool{
+		"172.17.0.2": true,
+		"172.17.0.1": false,
+		"10.0.0.1":   false,
+		"::1":        true,
+	} {
+		if list.Allowed(&net.UDPAddr{IP: net.ParseIP(address)}, nil) != expected {
+			t.Fatalf("expected %s to be allowed: %v", address, expected)
+		}
+	}
+	if list.Allowed(&net.UnixAddr{}, nil) || list.Allowed(nil, &peerCredentials{Uid: 0}) || !list.Allowed(nil, &peerCredentials{Uid: 1000}) {
+		t.Fatal("expected only the allowed uid on a unix socket")
+	}
+	if list.Rejected() != 4 {
+		t.Fatalf("expected 4 rejected packets got %d", list.Rejected())
+	}
+	if _, err := NewAccessList([]string{"172.17.0.0/33"}, nil, nil, nil); err == nil {
+		t.Fatal("expected an error for an invalid network")
+	}
+}
+
+func TestReadCredentials(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on linux")
+	}
+	address := &net.UnixAddr{Name: filepath.Join(t.TempDir(), "gelf.sock"), Net: "unixgram"}
+	conn, err := net.ListenUnixgram("unixgram", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := enableCredentials(conn); err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.DialUnix("unixgram", nil, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("{}"))
+	buf := make([]byte, 16)
+	n, _, peer, err := readCredentials(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || peer == nil || peer.Uid != uint32(os.Getuid()) || peer.Pid != int32(os.Getpid()) {
+		t.Fatalf("expected the credentials of this process got %+v", peer)
+	}
+}
@@ -0,0 +1,282 @@
+package net
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pbergman/logger"
+)
+
+// AdminRequest is the request send (as one JSON line) to the admin socket
+type AdminRequest struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+}
+
+// AdminResponse is the response written (as one JSON line) by the admin socket
+type AdminResponse struct {
+	Ok     bool        `json:"ok"`
+	Error  string      `json:"error,omitempty"`
+	Result interface{} `json:"result,omitempty"`
+}
+
+// AdminHandler handles a command of the admin socket, the returned
+// result is encoded as JSON in the response
+type AdminHandler func(args []string) (interface{}, error)
+
+// AdminStreamHandler handles a command that streams results. It validates the
+// arguments, an error is written as the response, and returns the function
+// that streams the results. Every value given to send is written as a JSON
+// line after the (ok) response and the function should return when done is
+// closed (the client disconnected or the server is closed).
+type AdminStreamHandler func(args []string) (AdminStreamFunc, error)
+
+// AdminStreamFunc streams the results of a stream command, see AdminStreamHandler
+type AdminStreamFunc func(send func(interface{}) error, done <-chan struct{}) error
+
+// AdminServer serves the admin commands on a unix socket so a
+// running process can be controlled (see the ctl command).
+type AdminServer struct {
+	listener net.Listener
+	logger   *logger.Logger
+	lock     sync.RWMutex
+	handlers map[string]AdminHandler
+	streams  map[string]AdminStreamHandler
+	wg       sync.WaitGroup
+	closed   chan struct{}
+}
+
+// HandleStream will register the stream handler for the given command
+func (a *AdminServer) HandleStream(command string, handler AdminStreamHandler) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.streams[command] = handler
+}
+
+// stream will run the stream handler till it returns, the client
+// disconnects or the server is closed
+func (a *AdminServer) stream(conn net.Conn, handler AdminStreamHandler, request *AdminRequest) {
+	encoder := json.NewEncoder(conn)
+	run, err := handler(request.Args)
+	if err != nil {
+		if err := encoder.Encode(&AdminResponse{Error: err.Error()}); err != nil {
+			a.logger.Debug(fmt.Sprintf("failed to write admin response: %s", err.Error()))
+		}
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// the client does not send anything after the
+		// request so this returns when it disconnects
+		buf := make([]byte, 1)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		select {
+		case <-a.closed:
+			conn.Close()
+		case <-done:
+		}
+	}()
+	if err := encoder.Encode(&AdminResponse{Ok: true}); err != nil {
+		return
+	}
+	err = run(func(v interface{}) error {
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		return encoder.Encode(v)
+	}, done)
+	if err != nil {
+		a.logger.Debug(fmt.Sprintf("admin stream '%s' stopped: %s", request.Command, err.Error()))
+	}
+}
+
+// Handle will register the handler for the given command
+func (a *AdminServer) Handle(command string, handler AdminHandler) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.handlers[command] = handler
+}
+
+// Commands returns the registered commands
+func (a *AdminServer) Commands() []string {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	var commands []string
+	for command := range a.handlers {
+		commands = append(commands, command)
+	}
+	for command := range a.streams {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+	return commands
+}
+
+func (a *AdminServer) handle(request *AdminRequest) *AdminResponse {
+	a.lock.RLock()
+	handler, ok := a.handlers[request.Command]
+	a.lock.RUnlock()
+	if !ok {
+		return &AdminResponse{Error: fmt.Sprintf("unknown command '%s'", request.Command)}
+	}
+	result, err := handler(request.Args)
+	if err != nil {
+		return &AdminResponse{Error: err.Error()}
+	}
+	return &AdminResponse{Ok: true, Result: result}
+}
+
+func (a *AdminServer) serve(conn net.Conn) {
+	defer a.wg.Done()
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var request AdminRequest
+	var response *AdminResponse
+	if line, err := bufio.NewReader(conn).ReadBytes('\n'); err != nil {
+		response = &AdminResponse{Error: "failed to read request: " + err.Error()}
+	} else if err := json.Unmarshal(line, &request); err != nil {
+		response = &AdminResponse{Error: "invalid request: " + err.Error()}
+	} else {
+		a.logger.Debug(fmt.Sprintf("admin command '%s' %q", request.Command, request.Args))
+		a.lock.RLock()
+		handler, ok := a.streams[request.Command]
+		a.lock.RUnlock()
+		if ok {
+			conn.SetReadDeadline(time.Time{})
+			a.stream(conn, handler, &request)
+			return
+		}
+		response = a.handle(&request)
+	}
+	conn.SetReadDeadline(time.Time{})
+	if err := json.NewEncoder(conn).Encode(response); err != nil {
+		a.logger.Debug(fmt.Sprintf("failed to write admin response: %s", err.Error()))
+	}
+}
+
+func (a *AdminServer) accept() {
+	for {
+		conn, err := a.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				a.logger.Error(fmt.Sprintf("admin socket stopped: %s", err.Error()))
+			}
+			return
+		}
+		a.wg.Add(1)
+		go a.serve(conn)
+	}
+}
+
+// Close will close the socket (and remove the socket file) and
+// waits till the running commands are finished
+func (a *AdminServer) Close() error {
+	close(a.closed)
+	err := a.listener.Close()
+	a.wg.Wait()
+	return err
+}
+
+// NewAdminServer will listen on the given unix socket path, a stale
+// socket file (of a process that is not running anymore) is removed.
+// The socket is only accessible by the user running the process.
+func NewAdminServer(path string, logger *logger.Logger) (*AdminServer, error) {
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("admin socket '%s' is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	server := &AdminServer{
+		listener: listener,
+		logger:   logger,
+		handlers: make(map[string]AdminHandler),
+		streams:  make(map[string]AdminStreamHandler),
+		closed:   make(chan struct{}),
+	}
+	go server.accept()
+	logger.Debug(fmt.Sprintf("serving admin commands on '%s'", path))
+	return server, nil
+}
+
+// AdminCall will send the command to the admin socket on the given path
+// and returns the response, an error response is returned as error.
+func AdminCall(path string, command string, args []string, timeout time.Duration) (*AdminResponse, error) {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := json.NewEncoder(conn).Encode(&AdminRequest{Command: command, Args: args}); err != nil {
+		return nil, err
+	}
+	var response AdminResponse
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		return nil, err
+	}
+	if !response.Ok {
+		return nil, errors.New(response.Error)
+	}
+	return &response, nil
+}
+
+// AdminStream will send the (stream) command to the admin socket on the
+// given path and calls fn for every streamed value till the stream ends,
+// fn returns an error or the process closes the socket.
+func AdminStream(path string, command string, args []string, fn func(json.RawMessage) error) error {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := json.NewEncoder(conn).Encode(&AdminRequest{Command: command, Args: args}); err != nil {
+		return err
+	}
+	var response AdminResponse
+	var decoder = json.NewDecoder(conn)
+	if err := decoder.Decode(&response); err != nil {
+		return err
+	}
+	if !response.Ok {
+		return errors.New(response.Error)
+	}
+	for {
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := fn(value); err != nil {
+			return err
+		}
+	}
+}
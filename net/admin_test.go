@@ -0,0 +1,45 @@
+package net
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/pbergman/logger"
+)
+
+func TestAdminServer_stream(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	server, err := NewAdminServer(path, logger.NewLogger("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.HandleStream("count", func(args []string) (AdminStreamFunc, error) {
+		if len(args) != 0 {
+			return nil, errors.New("invalid arguments")
+		}
+		return func(send func(interface{}) error, done <-chan struct{}) error {
+			for i := 0; i < 3; i++ {
+				if err := send(i); err != nil {
+					return err
+				}
+			}
+			return nil
+		}, nil
+	})
+	if err := AdminStream(path, "count", []string{"foo"}, func(json.RawMessage) error { return nil }); err == nil || err.Error() != "invalid arguments" {
+		t.Fatalf("expected the error of the handler as response got %v", err)
+	}
+	var values []string
+	if err := AdminStream(path, "count", nil, func(value json.RawMessage) error {
+		values = append(values, string(value))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 3 || values[2] != "2" {
+		t.Fatalf("expected the streamed values got %v", values)
+	}
+}
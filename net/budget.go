@@ -0,0 +1,128 @@
+package net
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrBudgetExceeded is set on queue items that are
+// dropped because the memory budget was exceeded
+var ErrBudgetExceeded = errors.New("memory budget exceeded")
+
+// Budget is a byte budget that is shared by the listener (chunks
+// and received packets) and the pool (queued messages) so there is
+// a limit on the memory that is used for holding messages.
+//
+// When the usage is above the shed watermark (80% of the limit) only
+// messages with a level equal or more severe than the shed level
+// are accepted, so on a storm the low severity messages are dropped
+// first. Critical (or more severe) messages are always accepted. A nil
+// budget is unlimited.
+type Budget struct {
+	limit     int64
+	watermark int64
+	level     int
+	used      int64
+}
+
+// Acquire will reserve n bytes and returns false when this
+// would exceed the limit, in that case nothing is reserved
+func (b *Budget) Acquire(n int) bool {
+	if b == nil {
+		return true
+	}
+	return b.reserve(int64(n), b.limit)
+}
+
+// Admit will reserve n bytes for a message with the given level and
+// returns false when it should be dropped according the shed policy
+func (b *Budget) Admit(n int, level int) bool {
+	if b == nil {
+		return true
+	}
+	if level <= LevelCritical {
+		atomic.AddInt64(&b.used, int64(n))
+		return true
+	}
+	if level > b.level {
+		return b.reserve(int64(n), b.watermark)
+	}
+	return b.reserve(int64(n), b.limit)
+}
+
+func (b *Budget) reserve(n, max int64) bool {
+	if atomic.AddInt64(&b.used, n) > max {
+		atomic.AddInt64(&b.used, -n)
+		return false
+	}
+	return true
+}
+
+// Release will free n bytes reserved by Acquire or Admit
+func (b *Budget) Release(n int) {
+	if b != nil {
+		atomic.AddInt64(&b.used, -int64(n))
+	}
+}
+
+// Used returns the amount of bytes that are reserved
+func (b *Budget) Used() int64 {
+	if b == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&b.used)
+}
+
+// Limit returns the max amount of bytes, 0 when unlimited
+func (b *Budget) Limit() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.limit
+}
+
+// ParseByteSize will parse a size like 512, 64KB, 256MiB or 1G where
+// the units are handled as powers of 1024 with or without the i.
+func ParseByteSize(value string) (int64, error) {
+	raw := strings.ToUpper(strings.TrimSpace(value))
+	index := strings.IndexFunc(raw, func(r rune) bool { return r < '0' || r > '9' })
+	unit := ""
+	if index >= 0 {
+		raw, unit = raw[:index], strings.TrimSpace(raw[index:])
+	}
+	size, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return 0, errors.New("invalid size '" + value + "'")
+	}
+	switch strings.TrimSuffix(strings.TrimSuffix(unit, "B"), "I") {
+	case "":
+		return size, nil
+	case "K":
+		return size << 10, nil
+	case "M":
+		return size << 20, nil
+	case "G":
+		return size << 30, nil
+	default:
+		return 0, errors.New("invalid unit for size '" + value + "', expected B, KB, MB or GB")
+	}
+}
+
+// NewBudget creates a budget for the given limit, messages with a level
+// above (less severe than) the shed level are dropped first. A limit of
+// 0 or less will return nil so it can be used as an unlimited budget.
+func NewBudget(limit int64, level int) *Budget {
+	if limit <= 0 {
+		return nil
+	}
+	budget := &Budget{
+		limit:     limit,
+		watermark: limit * 8 / 10,
+		level:     level,
+	}
+	metricMemoryUsed.Set(func() float64 { return float64(budget.Used()) })
+	metricMemoryLimit.Set(func() float64 { return float64(limit) })
+	return budget
+}
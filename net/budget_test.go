@@ -0,0 +1,57 @@
+package net
+
+import "testing"
+
+func TestBudget_Admit(t *testing.T) {
+	budget := NewBudget(100, 5)
+	if !budget.Admit(70, 6) {
+		t.Fatal("expected a low severity message to be accepted below the watermark")
+	}
+	if budget.Admit(20, 7) {
+		t.Fatal("expected a low severity message to be dropped above the watermark")
+	}
+	if !budget.Admit(20, 3) {
+		t.Fatal("expected a severe message to be accepted above the watermark")
+	}
+	if budget.Admit(5, gelfLevel([]byte(`{"level":1`))) {
+		t.Fatal("expected a message that can not be parsed to be dropped above the watermark")
+	}
+	if budget.Acquire(20) {
+		t.Fatal("expected acquire to fail when exceeding the limit")
+	}
+	budget.Release(90)
+	if budget.Used() != 0 {
+		t.Fatalf("expected all memory to be released got %d", budget.Used())
+	}
+	var unlimited *Budget
+	if !unlimited.Admit(1<<40, 7) || !unlimited.Acquire(1<<40) {
+		t.Fatal("expected a nil budget to be unlimited")
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	for value, expected := range map[string]int64{"512": 512, "64KB": 64 << 10, "256MiB": 256 << 20, "1g": 1 << 30, "0": 0} {
+		if size, err := ParseByteSize(value); err != nil || size != expected {
+			t.Fatalf("expected %d for '%s' got %d (%v)", expected, value, size, err)
+		}
+	}
+	for _, value := range []string{"", "MB", "10TB", "-1"} {
+		if _, err := ParseByteSize(value); err == nil {
+			t.Fatalf("expected an error for '%s'", value)
+		}
+	}
+}
+
+func TestGelfLevel(t *testing.T) {
+	for message, expected := range map[string]int{
+		`{"level":6}` + "\x00": 6,
+		`{"level":"3"}`:        3,
+		`{"short_message":""}`: 1,
+		`{"level":`:            LevelDebug,
+		`invalid`:              LevelDebug,
+	} {
+		if level := gelfLevel([]byte(message)); level != expected {
+			t.Fatalf("expected level %d for %q got %d", expected, message, level)
+		}
+	}
+}
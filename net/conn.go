@@ -1,7 +1,13 @@
 package net
 
 import (
+	"context"
+	"crypto/x509"
 	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
 
 	"github.com/pbergman/logger"
 )
@@ -21,27 +27,159 @@ type ConnPoolInterface interface {
 	// Push will create a non-blocking
 	// queue item that can be later check
 	Push(data []byte, id []byte) *ConnQueueItem
+	// PushInternal will push a message
+	// created by the proxy itself (like
+	// a heartbeat), these are delivered
+	// as any message but not counted as
+	// delivered in the state
+	PushInternal(data []byte, id []byte) *ConnQueueItem
 	// will write the given bytes to
 	// the remote and block until we
 	// we get some feedback
 	Write(data []byte) (int, error)
+	// Fatal returns a channel that will
+	// receive an error when the pool has
+	// stopped delivering messages because
+	// of an error that can not be resolved
+	// by retrying (like a pin mismatch)
+	Fatal() <-chan error
+	// State returns the connection and
+	// queue state of the pool
+	State() PoolState
+	// Pause will stop delivering messages
+	// till the pool is resumed, messages
+	// are queued in the meantime
+	Pause()
+	// Resume will continue delivering
+	// the queued messages
+	Resume()
+	// Flush will write the collected
+	// messages now and blocks till the
+	// queue is empty or ctx is done
+	Flush(ctx context.Context) error
+	// Drain will stop accepting messages
+	// and blocks till the queued messages
+	// are delivered or ctx is done, the
+	// pool should be closed after this
+	Drain(ctx context.Context) error
 }
 
-func NewConnPool(noClientAuth bool, tries int, address *GraylogHost, ca, crt, pem string, logger *logger.Logger) (ConnPoolInterface, error) {
+// ReloadInterface is implemented by the pools that use
+// certificates which can be reloaded without a restart
+type ReloadInterface interface {
+	// Reload will reload the certificates, on
+	// error the current certificates are kept
+	Reload() error
+}
+
+// CertificateInterface is implemented by the pools that
+// present a client certificate to the remote
+type CertificateInterface interface {
+	// Certificate returns the current client certificate,
+	// nil when no client certificate is used
+	Certificate() *x509.Certificate
+}
+
+// ConnOptions holds the remote settings that are not
+// part of the address, a nil value is a valid value
+// and will use the defaults.
+type ConnOptions struct {
+	// Header holds static headers that are added
+	// to every request send to a http(s) remote
+	Header http.Header
+	// Auth holds the credentials that are used to
+	// authenticate on a http(s) remote
+	Auth *HttpAuth
+	// Compression is used for compressing the
+	// messages send to a udp remote (default gzip)
+	Compression Compression
+	// ChunkSize is the max payload size of a udp
+	// datagram before a message is send in chunks
+	// (default ChunkSizeLan)
+	ChunkSize int
+	// Tls holds the settings for the secure remotes
+	Tls TlsOptions
+	// Proxy is the (http or socks5) proxy used for
+	// connecting to tcp and http(s) remotes
+	Proxy *url.URL
+	// ResolveInterval is the time the addresses of
+	// a remote are cached before it is resolved
+	// again, with 0 it is resolved on every connect
+	ResolveInterval time.Duration
+	// WriteTimeout is the deadline for writing a
+	// message to a tcp remote (0 for no deadline)
+	WriteTimeout time.Duration
+	// MaxAge is the max lifetime of a connection to
+	// a tcp remote before it is replaced (0 to disable)
+	MaxAge time.Duration
+	// FlushSize is the amount of bytes that is collected
+	// before it is written to a tcp remote (0 to disable)
+	FlushSize int
+	// FlushDelay is the max time to wait for more
+	// messages before the collected are written
+	FlushDelay time.Duration
+	// Budget is the memory budget the queued
+	// messages are accounted against (nil for
+	// no limit)
+	Budget *Budget
+	// QueueSize is the max amount of messages that
+	// are queued before the least severe messages
+	// are dropped (default 1000)
+	QueueSize int
+}
+
+// queueSize returns the configured queue size or the default
+func queueSize(options *ConnOptions) int {
+	if options == nil || options.QueueSize <= 0 {
+		return 1000
+	}
+	return options.QueueSize
+}
+
+func NewConnPool(tries int, address *GraylogHost, options *ConnOptions, logger *logger.Logger) (ConnPoolInterface, error) {
+	if options == nil {
+		options = new(ConnOptions)
+	}
+	if options.Proxy != nil {
+		logger.Debug(fmt.Sprintf("using proxy '%s'", options.Proxy.Redacted()))
+	}
 	switch network := address.GetNetwork(); network {
 	case "tcp", "tcp4", "tcp6":
-		if !noClientAuth && address.IsSecure() {
-			return NewTcpTlsConnPool(tries, address, ca, crt, pem, logger)
+		if address.IsSecure() {
+			loader, err := newTlsLoader(&options.Tls, logger)
+			if err != nil {
+				return nil, err
+			}
+			return NewTcpTlsConnPool(tries, address, loader, options, logger)
 		} else {
-			return NewTcpConnPool(tries, address, logger)
+			return NewTcpConnPool(tries, address, options, logger)
 		}
+	case "udp", "udp4", "udp6":
+		return NewUdpConnPool(tries, address, options, logger)
 	case "http", "https":
-		if !noClientAuth && address.IsSecure() {
-			return NewHttpsConnPool(tries, address, ca, crt, pem, logger)
+		if address.IsSecure() {
+			loader, err := newTlsLoader(&options.Tls, logger)
+			if err != nil {
+				return nil, err
+			}
+			return NewHttpsConnPool(tries, address, loader, options, logger)
 		} else {
-			return NewHttpConnPool(tries, address, logger)
+			return NewHttpConnPool(tries, address, options, logger)
 		}
 	default:
 		return nil, errors.New("unsupported network provided '" + network + "'")
 	}
 }
+
+// newTlsLoader will create the loader for the secure pools and
+// starts the watcher when a reload interval is configured.
+func newTlsLoader(options *TlsOptions, logger *logger.Logger) (*TlsLoader, error) {
+	loader, err := NewTlsLoader(options, logger)
+	if err != nil {
+		return nil, err
+	}
+	if options.ReloadInterval > 0 {
+		go loader.Watch(options.ReloadInterval)
+	}
+	return loader, nil
+}
@@ -2,35 +2,104 @@ package net
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"sync"
+	"time"
 
 	"github.com/pbergman/logger"
 )
 
 type HttpConnPool struct {
 	connQueue
-	clients []*http.Client
-	host    *GraylogHost
-	lock    sync.Mutex
-	pool    *sync.Pool
-	logger  *logger.Logger
+	clients  []*http.Client
+	host     *GraylogHost
+	header   http.Header
+	auth     *HttpAuth
+	proxy    *url.URL
+	resolver *Resolver
+	lock     sync.Mutex
+	pool     *sync.Pool
 }
 
-func (p HttpConnPool) Close() {
-	close(p.queue)
+func (p *HttpConnPool) Close() {
+	p.close()
 }
 
-func (p HttpConnPool) Start(workers int) {
+func (p *HttpConnPool) Start(workers int) {
 	p.clients = make([]*http.Client, workers)
 	for i := 0; i < workers; i++ {
 		p.wg.Add(1)
-		p.clients[i] = &http.Client{}
+		p.clients[i] = &http.Client{Transport: p.newTransport(nil)}
 		go p.process(p.clients[i], &p.wg)
 	}
 }
 
+// newTransport creates the transport for the http clients, the connections are
+// created by the Dialer so when a proxy is configured the (tls) connection is
+// tunneled through the proxy.
+func (p *HttpConnPool) newTransport(config *tls.Config) *http.Transport {
+	dialer := &Dialer{
+		Dialer: net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		},
+		Proxy:    p.proxy,
+		Resolver: p.resolver,
+		Remote:   p.name,
+	}
+	// the connections are tracked for the health endpoints
+	transport := &http.Transport{
+		TLSClientConfig: config,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return p.track(dialer.DialContext(ctx, network, address))
+		},
+	}
+	// the tls handshake is done by the dialer so the
+	// failed handshakes are reported in the metrics
+	if config != nil {
+		transport.DialTLSContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return p.track(dialer.DialTlsContext(ctx, network, address, config))
+		}
+	}
+	// keep the proxy from the environment for plain http
+	// remotes when no proxy is configured, as it was when
+	// the default transport was used.
+	if config == nil && p.proxy == nil {
+		transport.Proxy = http.ProxyFromEnvironment
+	}
+	return transport
+}
+
+// track will count the dialed connection till it is closed by the transport
+func (p *HttpConnPool) track(conn net.Conn, err error) (net.Conn, error) {
+	if err != nil {
+		p.state.failure(err)
+		return nil, err
+	}
+	return p.state.track(conn), nil
+}
+
+func (p *HttpConnPool) newRequest(body io.Reader) (*http.Request, error) {
+	request, err := http.NewRequest("POST", p.host.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range p.header {
+		for _, value := range values {
+			request.Header.Add(name, value)
+		}
+	}
+	p.auth.apply(request)
+	return request, nil
+}
+
 func (p *HttpConnPool) post(item *ConnQueueItem, conn *http.Client) error {
 	buf := p.pool.Get().(*bytes.Buffer)
 	defer p.pool.Put(buf)
@@ -38,8 +107,8 @@ func (p *HttpConnPool) post(item *ConnQueueItem, conn *http.Client) error {
 	if _, err := buf.Write(item.data); err != nil {
 		return err
 	}
-	p.logger.Info(fmt.Sprintf("[%X] [POST] %d bytes to '%s'", item.id, buf.Len(), p.host.String()))
-	request, err := http.NewRequest("POST", p.host.String(), buf)
+	p.logger.Info(logf(item.logFields(logFields{"bytes": buf.Len(), "remote": p.name}), "[%X] [POST] %d bytes to '%s'", item.id, buf.Len(), p.host.String()))
+	request, err := p.newRequest(buf)
 	if err != nil {
 		return err
 	}
@@ -47,44 +116,79 @@ func (p *HttpConnPool) post(item *ConnQueueItem, conn *http.Client) error {
 	if err != nil {
 		return err
 	}
-	p.logger.Info(fmt.Sprintf("[%X] [POST] %s", item.id, response.Status))
+	io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
+	p.logger.Info(logf(item.logFields(logFields{"status": response.StatusCode, "remote": p.name}), "[%X] [POST] %s", item.id, response.Status))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return &StatusError{Code: response.StatusCode, Status: response.Status}
+	}
 	return nil
 
 }
 
 func (p *HttpConnPool) process(conn *http.Client, wg *sync.WaitGroup) {
 	defer wg.Done()
-	for item := range p.queue {
+	for {
+		item, ok := p.next()
+		if !ok {
+			break
+		}
+		if p.discard(item) {
+			continue
+		}
 		if err := p.post(item, conn); err != nil {
-			item.tries++
-			item.error = append(item.error, err)
+			if isFatal(err) {
+				p.logger.Emergency(logf(logFields{"remote": p.name, "error": err.Error()}, "stopped delivering messages to '%s': %s", p.host.String(), err.Error()))
+				p.fail(err)
+				p.discard(item)
+				continue
+			}
+			p.failure(item, err)
 			p.logger.Debug(fmt.Sprintf("[%X] %#v", item.id, err))
-			p.logger.Error(fmt.Sprintf("[%X] %s", item.id, err.Error()))
+			p.logger.Error(logf(item.logFields(logFields{"remote": p.name, "error": err.Error()}), "[%X] %s", item.id, err.Error()))
 			if item.tries < p.tries {
-				p.queue <- item
+				p.requeue(item)
 			} else {
-				p.logger.Alert(fmt.Sprintf("[%X] discarded message after %d retires", item.id, item.tries))
-				close(item.status)
+				p.logger.Alert(logf(item.logFields(logFields{"remote": p.name, "tries": item.tries}), "[%X] discarded message after %d retires", item.id, item.tries))
+				p.discarded(item, "retries")
 			}
 
 		} else {
-			close(item.status)
+			p.delivered(item)
 		}
 	}
 }
 
-func NewHttpConnPool(tries int, host *GraylogHost, logger *logger.Logger) (ConnPoolInterface, error) {
-	return &HttpConnPool{
-		host:   host,
-		logger: logger,
+func newHttpConnPool(tries int, host *GraylogHost, options *ConnOptions, logger *logger.Logger) *HttpConnPool {
+	pool := &HttpConnPool{
+		host: host,
 		pool: &sync.Pool{
 			New: func() interface{} {
 				return new(bytes.Buffer)
 			},
 		},
 		connQueue: connQueue{
-			tries: tries,
-			queue: make(chan *ConnQueueItem, 10),
+			tries:  tries,
+			name:   host.String(),
+			queue:  newPriorityQueue(queueSize(options)),
+			logger: logger,
 		},
-	}, nil
+	}
+	if options != nil {
+		pool.header = options.Header
+		pool.auth = options.Auth
+		pool.proxy = options.Proxy
+		pool.resolver = NewResolver(options.ResolveInterval, logger)
+		pool.budget = options.Budget
+	}
+	logger.Debug(fmt.Sprintf("using authentication: %s", pool.auth))
+	for name := range pool.header {
+		logger.Debug(fmt.Sprintf("using header: '%s'", name))
+	}
+	pool.register()
+	return pool
+}
+
+func NewHttpConnPool(tries int, host *GraylogHost, options *ConnOptions, logger *logger.Logger) (ConnPoolInterface, error) {
+	return newHttpConnPool(tries, host, options, logger), nil
 }
@@ -0,0 +1,38 @@
+package net
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pbergman/logger"
+)
+
+func TestHttpConnPool_status(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+	pool := newHttpConnPool(2, NewGraylogHost(server.URL+"/gelf"), nil, logger.NewLogger("test"))
+	pool.Start(1)
+	defer pool.Close()
+	item := pool.Push([]byte(`{"short_message":"test"}`), nil)
+	<-item.status
+	if state := pool.State(); item.Tries() != 1 || len(item.Error()) != 1 || state.Delivered != 1 || state.Retried != 1 {
+		t.Fatalf("expected the message to be retried after the unauthorized response, got %v and %+v", item.Error(), state)
+	}
+	if err, ok := item.Error()[0].(*StatusError); !ok || err.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a status error got %v", item.Error()[0])
+	}
+	item = pool.Push([]byte(`{"short_message":"test"}`), nil)
+	<-item.status
+	if item.HasError() {
+		t.Fatalf("expected the message to be delivered got %v", item.Error())
+	}
+}
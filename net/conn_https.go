@@ -1,66 +1,49 @@
 package net
 
 import (
-	"bytes"
-	"crypto/tls"
 	"crypto/x509"
-	"fmt"
-	"io/ioutil"
 	"net/http"
-	"sync"
+	"net/url"
 
 	"github.com/pbergman/logger"
 )
 
 type HttpsConnPool struct {
-	config *tls.Config
-	HttpConnPool
+	tls *TlsLoader
+	*HttpConnPool
 }
 
-func (p HttpsConnPool) Start(workers int) {
+// Reload will reload the certificates used for new connections
+func (p *HttpsConnPool) Reload() error {
+	return p.tls.Reload()
+}
+
+// Certificate returns the client certificate used for new connections
+func (p *HttpsConnPool) Certificate() *x509.Certificate {
+	return p.tls.Certificate()
+}
+
+func (p *HttpsConnPool) Close() {
+	p.tls.Close()
+	p.HttpConnPool.Close()
+}
+
+func (p *HttpsConnPool) Start(workers int) {
+	var host string
+	if remote, err := url.Parse(p.host.String()); err == nil {
+		host = remote.Hostname()
+	}
 	p.clients = make([]*http.Client, workers)
 	for i := 0; i < workers; i++ {
 		p.wg.Add(1)
-		p.clients[i] = &http.Client{
-			Transport: &http.Transport{
-				TLSClientConfig: p.config,
-			},
-		}
+		p.clients[i] = &http.Client{Transport: p.newTransport(p.tls.Config(host))}
 		go p.process(p.clients[i], &p.wg)
 	}
 }
 
-func NewHttpsConnPool(tries int, host *GraylogHost, ca, crt, pem string, logger *logger.Logger) (ConnPoolInterface, error) {
-	buf, err := ioutil.ReadFile(ca)
-	if err != nil {
-		return nil, err
-	}
-	logger.Debug(fmt.Sprintf("loaded ca root certificate: '%s'", ca))
-	certPool := x509.NewCertPool()
-	certPool.AppendCertsFromPEM(buf)
-	pair, err := tls.LoadX509KeyPair(crt, pem)
-	if err != nil {
-		return nil, err
-	}
-	logger.Debug(fmt.Sprintf("loaded certificate: '%s'", crt))
-	logger.Debug(fmt.Sprintf("loaded private key: '%s'", pem))
+func NewHttpsConnPool(tries int, host *GraylogHost, loader *TlsLoader, options *ConnOptions, logger *logger.Logger) (ConnPoolInterface, error) {
 	return &HttpsConnPool{
-		HttpConnPool: HttpConnPool{
-			host:   host,
-			logger: logger,
-			pool: &sync.Pool{
-				New: func() interface{} {
-					return new(bytes.Buffer)
-				},
-			},
-			connQueue: connQueue{
-				tries: tries,
-				queue: make(chan *ConnQueueItem, 10),
-			},
-		},
-		config: &tls.Config{
-			RootCAs:      certPool,
-			Certificates: []tls.Certificate{pair},
-		},
+		HttpConnPool: newHttpConnPool(tries, host, options, logger),
+		tls:          loader,
 	}, nil
 }
@@ -1,11 +1,36 @@
 package net
 
+import "time"
+
 type ConnQueueItem struct {
-	status chan struct{}
-	tries  int
-	error  []error
-	data   []byte
-	id     []byte
+	status  chan struct{}
+	tries   int
+	error   []error
+	data    []byte
+	id      []byte
+	level   int
+	shed    bool
+	created time.Time
+	// trace is the _trace_id field of the message
+	trace string
+	// internal is set for the messages created by the proxy
+	// itself (like a heartbeat), these are not counted as
+	// delivered messages in the state of the pool
+	internal bool
+}
+
+// logFields adds the message id and trace id to the given fields, the
+// internal messages are marked so the records about these are not
+// forwarded by the GelfLogHandler
+func (c *ConnQueueItem) logFields(fields logFields) logFields {
+	fields["id"] = hexId(c.id)
+	if c.internal {
+		fields["internal"] = true
+	}
+	if c.trace != "" {
+		fields["trace_id"] = c.trace
+	}
+	return fields
 }
 
 // Tries will return a int representing the amount
@@ -20,6 +45,17 @@ func (c ConnQueueItem) Wait() {
 	<-c.status
 }
 
+// Level returns the level of the GELF message
+func (c ConnQueueItem) Level() int {
+	return c.level
+}
+
+// Shed returns true when the item was dropped
+// because the memory budget was exceeded
+func (c ConnQueueItem) Shed() bool {
+	return c.shed
+}
+
 // Error will return the errors
 func (c ConnQueueItem) Error() []error {
 	return c.error
@@ -1,12 +1,12 @@
 package net
 
 import (
-	"fmt"
+	"bytes"
+	"io"
 	"net"
+	"net/url"
 	"sync"
 	"time"
-
-	"github.com/pbergman/logger"
 )
 
 type connPool struct {
@@ -14,9 +14,37 @@ type connPool struct {
 
 	pool      []net.Conn
 	lock      sync.Mutex
-	logger    *logger.Logger
+	proxy     *url.URL
+	resolver  *Resolver
 	KeepAlive time.Duration
 	Timeout   time.Duration
+	// WriteTimeout is the deadline for writing a
+	// message so a worker can not hang on a half
+	// open connection, 0 will disable the deadline
+	WriteTimeout time.Duration
+	// MaxAge is the max lifetime of a connection
+	// before it is replaced, 0 will disable it
+	MaxAge time.Duration
+	// FlushSize is the amount of bytes that is collected
+	// from the queue before it is written, 0 will write
+	// every message on its own
+	FlushSize int
+	// FlushDelay is the max time to wait for more messages
+	// when the flush size is not reached, 0 will only use
+	// the messages that are already queued
+	FlushDelay time.Duration
+}
+
+func (c *connPool) dialer() *Dialer {
+	return &Dialer{
+		Dialer: net.Dialer{
+			KeepAlive: c.KeepAlive,
+			Timeout:   c.Timeout,
+		},
+		Proxy:    c.proxy,
+		Resolver: c.resolver,
+		Remote:   c.name,
+	}
 }
 
 func (c *connPool) Close() {
@@ -28,47 +56,228 @@ func (c *connPool) Close() {
 		}
 	}
 	c.pool = nil
-	close(c.queue)
+	c.connQueue.close()
 }
 
 func (c *connPool) start(workers int, bind func(*net.Conn) (err error)) {
 	c.pool = make([]net.Conn, workers)
 	for i := 0; i < workers; i++ {
 		c.wg.Add(1)
-		go c.process(c.pool[i], &c.wg, bind)
+		go c.process(c.pool[i], &c.wg, c.track(bind), i == 0)
 	}
 }
 
-func (c *connPool) process(conn net.Conn, wg *sync.WaitGroup, bind func(*net.Conn) (err error)) {
-	defer wg.Done()
-	for item := range c.queue {
-		if nil == conn {
-			if err := bind(&conn); err != nil {
-				// on error just return/stop this and
-				// close message because this should
-				// be a connection error
-				c.logger.Error(err)
-				close(item.status)
-				return
-			}
+// track will wrap the bind function so the open connections
+// are counted and failed connects are recorded in the state
+func (c *connPool) track(bind func(*net.Conn) error) func(*net.Conn) error {
+	return func(conn *net.Conn) error {
+		if err := bind(conn); err != nil {
+			c.state.failure(err)
+			return err
 		}
-		n, err := conn.Write(item.data)
-		c.logger.Info(fmt.Sprintf("[%X] written %d bytes to '%s'", item.id, n, conn.RemoteAddr().String()))
-		if err != nil {
-			c.logger.Error(fmt.Sprintf("[%X] %s", item.id, err.Error()))
-			item.tries++
-			item.error = append(item.error, err)
-			if item.tries < 5 {
-				c.queue <- item
-			} else {
-				c.logger.Alert(fmt.Sprintf("[%X] discarded message after %d retires", item.id, item.tries))
-			}
-			// on error just reset the connection this
-			// could be a timeout or closed connection.
-			conn.Close()
+		*conn = c.state.track(*conn)
+		return nil
+	}
+}
+
+// idleProbe is the time a connection can be idle before
+// it is checked with a read probe before it is used again
+const idleProbe = time.Second
+
+// healthy will check if the connection can still be used, a connection
+// that is idle is probed with a short read so a connection that was
+// closed by the remote (or a proxy in between) is detected before we
+// write a message on it that would be lost.
+func (c *connPool) healthy(conn net.Conn, created, used time.Time) bool {
+	if c.MaxAge > 0 && time.Since(created) > c.MaxAge {
+		c.logger.Debug(logf(logFields{"remote": c.name, "address": conn.RemoteAddr().String()}, "recycling connection to '%s' after %s", conn.RemoteAddr().String(), c.MaxAge))
+		return false
+	}
+	if time.Since(used) < idleProbe {
+		return true
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	defer conn.SetReadDeadline(time.Time{})
+	// the remote should not send anything so we
+	// expect a timeout for a healthy connection
+	_, err := conn.Read(make([]byte, 1))
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return true
+	}
+	if err != nil {
+		c.logger.Debug(logf(logFields{"remote": c.name, "address": conn.RemoteAddr().String(), "error": err.Error()}, "connection to '%s' is not usable anymore: %s", conn.RemoteAddr().String(), err.Error()))
+	} else {
+		c.logger.Debug(logf(logFields{"remote": c.name, "address": conn.RemoteAddr().String()}, "unexpected data received from '%s'", conn.RemoteAddr().String()))
+	}
+	return false
+}
+
+// collect will create a batch from the given items and the items that
+// are queued till the flush size is reached. When the queue is empty
+// it will wait for new items till the flush delay has passed. It will
+// return true when the queue is closed.
+func (c *connPool) collect(pending []*ConnQueueItem) ([]*ConnQueueItem, bool) {
+	var batch []*ConnQueueItem
+	var size int
+	for _, item := range pending {
+		if !c.discard(item) {
+			batch = append(batch, item)
+			size += len(item.data)
+		}
+	}
+	for len(batch) == 0 {
+		item, ok := c.next()
+		if !ok {
+			return nil, true
+		}
+		if !c.discard(item) {
+			batch = append(batch, item)
+			size += len(item.data)
+		}
+	}
+	// with no delay we only take the items that are queued
+	var timeout = expired
+	if c.FlushDelay > 0 {
+		timer := time.NewTimer(c.FlushDelay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for size < c.FlushSize {
+		item, ok := c.queue.pop(timeout)
+		if !ok {
+			return batch, true
+		}
+		if item == nil {
+			return batch, false
+		}
+		if !c.discard(item) {
+			batch = append(batch, item)
+			size += len(item.data)
+		}
+	}
+	return batch, false
+}
+
+// write will write the batch with one write call so small messages
+// are send in one tcp packet or tls record instead of one per message
+func (c *connPool) write(conn net.Conn, buf *bytes.Buffer, batch []*ConnQueueItem) (int, error) {
+	data := batch[0].data
+	if len(batch) > 1 {
+		buf.Reset()
+		for _, item := range batch {
+			buf.Write(item.data)
+		}
+		data = buf.Bytes()
+	}
+	if c.WriteTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(c.WriteTimeout))
+	}
+	n, err := conn.Write(data)
+	if err == nil && n < len(data) {
+		err = io.ErrShortWrite
+	}
+	if len(batch) > 1 {
+		c.logger.Debug(logf(logFields{"remote": c.name, "address": conn.RemoteAddr().String(), "messages": len(batch), "bytes": n}, "flushed %d messages (%d bytes) to '%s'", len(batch), n, conn.RemoteAddr().String()))
+	}
+	return n, err
+}
+
+// retry will return true when the item should be tried again or
+// closes the item when the max amount of tries has been reached
+func (c *connPool) retry(item *ConnQueueItem, err error) bool {
+	c.logger.Error(logf(item.logFields(logFields{"remote": c.name, "error": err.Error()}), "[%X] %s", item.id, err.Error()))
+	c.failure(item, err)
+	if item.tries < c.tries {
+		c.retried()
+		return true
+	}
+	c.logger.Alert(logf(item.logFields(logFields{"remote": c.name, "tries": item.tries}), "[%X] discarded message after %d retires", item.id, item.tries))
+	c.discarded(item, "retries")
+	return false
+}
+
+// process will write the queued messages, when connect is true a connection
+// is made on start so the pool reports a healthy connection before the first
+// message is received.
+func (c *connPool) process(conn net.Conn, wg *sync.WaitGroup, bind func(*net.Conn) (err error), connect bool) {
+	defer wg.Done()
+	var created, used time.Time
+	if connect && nil == conn {
+		if err := bind(&conn); err != nil {
+			c.logger.Warning(logf(logFields{"remote": c.name, "error": err.Error()}, "failed to connect: %s", err.Error()))
 			conn = nil
 		} else {
-			close(item.status)
+			created, used = time.Now(), time.Now()
+		}
+	}
+	var failures int
+	var buf bytes.Buffer
+	// pending holds the items that failed and are tried again by this
+	// worker before new items so they are not pushed back on the queue
+	var pending []*ConnQueueItem
+	for {
+		batch, closed := c.collect(pending)
+		pending = nil
+		if len(batch) > 0 {
+			if nil != conn && !c.healthy(conn, created, used) {
+				conn.Close()
+				conn = nil
+			}
+			if nil == conn {
+				if err := bind(&conn); err != nil {
+					conn = nil
+					if isFatal(err) {
+						c.logger.Emergency(logf(logFields{"remote": c.name, "error": err.Error()}, "stopped delivering messages: %s", err.Error()))
+						c.fail(err)
+						for _, item := range batch {
+							c.discard(item)
+						}
+						continue
+					}
+					for _, item := range batch {
+						if c.retry(item, err) {
+							pending = append(pending, item)
+						}
+					}
+					// back off so we don't burn through the
+					// retries while the remote is unreachable
+					if failures < 10 {
+						failures++
+					}
+					time.Sleep(time.Duration(failures) * 500 * time.Millisecond)
+					continue
+				}
+				failures = 0
+				created = time.Now()
+			}
+			used = time.Now()
+			n, err := c.write(conn, &buf, batch)
+			// the items that are completely written are marked as
+			// done and the others will be tried again when it failed
+			for _, item := range batch {
+				if n >= len(item.data) {
+					n -= len(item.data)
+					c.logger.Info(logf(item.logFields(logFields{"remote": c.name, "address": conn.RemoteAddr().String(), "bytes": len(item.data)}), "[%X] written %d bytes to '%s'", item.id, len(item.data), conn.RemoteAddr().String()))
+					c.delivered(item)
+					continue
+				}
+				n = 0
+				if c.retry(item, err) {
+					pending = append(pending, item)
+				}
+			}
+			if err != nil {
+				// on error just reset the connection this
+				// could be a timeout or closed connection.
+				conn.Close()
+				conn = nil
+			}
+		}
+		if closed && len(pending) == 0 {
+			break
 		}
 	}
+	if nil != conn {
+		conn.Close()
+	}
 }
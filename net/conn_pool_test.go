@@ -0,0 +1,121 @@
+package net
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pbergman/logger"
+)
+
+func TestConnPool_healthy(t *testing.T) {
+	pool := &connPool{connQueue: connQueue{logger: logger.NewLogger("test")}, MaxAge: time.Minute}
+	client, server := net.Pipe()
+	defer client.Close()
+	idle := time.Now().Add(-2 * idleProbe)
+	if !pool.healthy(client, time.Now(), idle) {
+		t.Fatal("expected an open connection to be healthy")
+	}
+	if pool.healthy(client, time.Now().Add(-2*time.Minute), time.Now()) {
+		t.Fatal("expected a connection older than the max age to be recycled")
+	}
+	server.Close()
+	if !pool.healthy(client, time.Now(), time.Now()) {
+		t.Fatal("expected a recently used connection not to be probed")
+	}
+	if pool.healthy(client, time.Now(), idle) {
+		t.Fatal("expected a closed connection not to be healthy")
+	}
+}
+
+// testConn will accept up to limit bytes (-1 for no limit)
+type testConn struct {
+	net.Conn
+	limit   int
+	written []byte
+	writes  int
+}
+
+func (c *testConn) Write(b []byte) (int, error) {
+	c.writes++
+	if c.limit >= 0 && len(b) > c.limit {
+		c.written = append(c.written, b[:c.limit]...)
+		return c.limit, io.ErrClosedPipe
+	}
+	c.written = append(c.written, b...)
+	return len(b), nil
+}
+
+func (c *testConn) RemoteAddr() net.Addr { return &net.TCPAddr{} }
+func (c *testConn) Close() error         { return nil }
+
+func TestConnPool_process(t *testing.T) {
+	pool := &connPool{
+		FlushSize: 1024,
+		connQueue: connQueue{tries: 2, queue: newPriorityQueue(10), logger: logger.NewLogger("test")},
+	}
+	conns := []*testConn{{limit: 15}, {limit: -1}}
+	var binds int
+	bind := func(conn *net.Conn) error {
+		*conn = conns[binds]
+		binds++
+		return nil
+	}
+	items := []*ConnQueueItem{
+		pool.Push([]byte("aaaaaaaaaa"), nil),
+		pool.Push([]byte("bbbbbbbbbb"), nil),
+		pool.Push([]byte("cccccccccc"), nil),
+	}
+	pool.start(1, bind)
+	for _, item := range items {
+		<-item.status
+	}
+	pool.Close()
+	pool.Wait()
+	if conns[0].writes != 1 || string(conns[0].written) != "aaaaaaaaaabbbbb" {
+		t.Fatalf("expected one write of the batch on the first connection, got %d: %q", conns[0].writes, conns[0].written)
+	}
+	if conns[1].writes != 1 || string(conns[1].written) != "bbbbbbbbbbcccccccccc" {
+		t.Fatalf("expected the failed items to be written on the second connection, got %d: %q", conns[1].writes, conns[1].written)
+	}
+	for i, tries := range []int{0, 1, 1} {
+		if items[i].tries != tries {
+			t.Fatalf("expected item %d to have %d tries got %d", i, tries, items[i].tries)
+		}
+	}
+}
+
+func TestConnPool_Drain(t *testing.T) {
+	pool := &connPool{connQueue: connQueue{tries: 1, queue: newPriorityQueue(10), logger: logger.NewLogger("test")}}
+	conn := &testConn{limit: -1}
+	pool.Pause()
+	items := []*ConnQueueItem{
+		pool.Push([]byte("aaaaaaaaaa"), nil),
+		pool.Push([]byte("bbbbbbbbbb"), nil),
+	}
+	pool.start(1, func(c *net.Conn) error {
+		*c = conn
+		return nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := pool.Drain(ctx); err != nil {
+		t.Fatalf("expected the paused pool to be drained, got %s", err)
+	}
+	for i, item := range items {
+		select {
+		case <-item.status:
+		default:
+			t.Fatalf("expected item %d to be delivered", i)
+		}
+	}
+	if string(conn.written) != "aaaaaaaaaabbbbbbbbbb" {
+		t.Fatalf("expected the queued items to be written, got %q", conn.written)
+	}
+	if item := pool.Push([]byte("cccccccccc"), nil); len(item.error) == 0 {
+		t.Fatal("expected a drained pool not to accept new items")
+	}
+	pool.Close()
+}
@@ -1,55 +1,291 @@
 package net
 
 import (
-	"crypto/sha1"
+	"context"
+	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/pbergman/logger"
 )
 
 type connQueue struct {
-	wg    sync.WaitGroup
-	queue chan *ConnQueueItem
-	tries int
+	wg     sync.WaitGroup
+	queue  *priorityQueue
+	tries  int
+	once   sync.Once
+	failed sync.Once
+	fatal  chan error
+	halted int32
+	paused int32
+	err    error
+	budget *Budget
+	logger *logger.Logger
+	// name is the remote used as label for the metrics
+	name  string
+	state connState
+}
+
+// isFatal returns true for errors that will not be resolved by
+// retrying, like a remote that does not match the pinned keys
+func isFatal(err error) bool {
+	var pin *PinError
+	return errors.As(err, &pin)
+}
+
+func (c *connQueue) init() {
+	c.once.Do(func() {
+		c.fatal = make(chan error, 1)
+	})
+}
+
+// Fatal returns a channel that receives an error when the pool
+// stopped delivering messages because of an unrecoverable error
+func (c *connQueue) Fatal() <-chan error {
+	c.init()
+	return c.fatal
+}
+
+// fail will halt the queue so that all following items are
+// discarded and report the error on the fatal channel
+func (c *connQueue) fail(err error) {
+	c.init()
+	c.failed.Do(func() {
+		c.err = err
+		atomic.StoreInt32(&c.halted, 1)
+		c.fatal <- &FatalError{err}
+	})
+}
+
+// discard will close the item with the fatal error when the queue
+// is halted and returns true when the item was discarded
+func (c *connQueue) discard(item *ConnQueueItem) bool {
+	if atomic.LoadInt32(&c.halted) == 0 {
+		return false
+	}
+	item.error = append(item.error, c.err)
+	c.discarded(item, "fatal")
+	return true
 }
 
-func (c connQueue) Wait() {
+func (c *connQueue) Wait() {
 	c.wg.Wait()
 }
 
 func (c *connQueue) newQueueItem(b []byte, id []byte) *ConnQueueItem {
 	if nil == id {
-		hasher := sha1.New()
-		hasher.Write(b)
-		now := time.Now().Unix()
-		hasher.Write([]byte{
-			byte(now),
-			byte(now >> 8),
-			byte(now >> 16),
-			byte(now >> 24),
-			byte(now >> 32),
-			byte(now >> 40),
-			byte(now >> 48),
-			byte(now >> 56),
-		})
-		id = hasher.Sum(nil)
-	}
-	return &ConnQueueItem{
-		status: make(chan struct{}),
-		error:  make([]error, 0),
-		data:   b,
-		id:     id,
+		id = newMessageId()
+	}
+	item := &ConnQueueItem{
+		status:  make(chan struct{}),
+		error:   make([]error, 0),
+		data:    b,
+		id:      id,
+		created: time.Now(),
+	}
+	item.level, item.trace = gelfFields(b)
+	return item
+}
+
+// register will register the queue depth metric of the pool
+func (c *connQueue) register() {
+	metricQueueDepth.SetFor(c.queue, func() float64 { return float64(c.queue.Len()) }, c.name)
+}
+
+// close will close the queue and removes the queue depth metric
+func (c *connQueue) close() {
+	c.queue.close()
+	metricQueueDepth.RemoveFor(c.queue, c.name)
+}
+
+// delivered will close the item that was successfully delivered
+func (c *connQueue) delivered(item *ConnQueueItem) {
+	metricDeliveries.Inc(c.name)
+	c.state.success(item.internal)
+	observeLatency(c.name, item.created)
+	c.done(item)
+}
+
+// discarded will close the item that could not be delivered
+func (c *connQueue) discarded(item *ConnQueueItem, reason string) {
+	metricDiscards.Inc(c.name, reason)
+	atomic.AddUint64(&c.state.discarded, 1)
+	c.done(item)
+}
+
+// done will close the item and release the
+// memory that was reserved for the item
+func (c *connQueue) done(item *ConnQueueItem) {
+	close(item.status)
+	c.budget.Release(len(item.data))
+}
+
+// dropLogger returns the log function for a dropped item, a dropped
+// internal message is logged as debug so the logs about a full queue
+// do not create more internal messages (when the logs are forwarded)
+func (c *connQueue) dropLogger(item *ConnQueueItem) func(message interface{}) {
+	if item.internal {
+		return c.logger.Debug
+	}
+	return c.logger.Warning
+}
+
+// admit will check the budget for the given item, when it
+// exceeds the budget the item is closed with an error
+func (c *connQueue) admit(item *ConnQueueItem) bool {
+	level := item.level
+	if item.internal {
+		level = queueLevel(item)
+	}
+	if c.budget.Admit(len(item.data), level) {
+		return true
 	}
+	item.error = append(item.error, ErrBudgetExceeded)
+	item.shed = true
+	metricDiscards.Inc(c.name, "budget")
+	atomic.AddUint64(&c.state.discarded, 1)
+	c.dropLogger(item)(logf(item.logFields(logFields{"remote": c.name, "level": item.level, "error": ErrBudgetExceeded.Error()}), "[%X] dropped message with level %d, %s (%d of %d bytes used)", item.id, item.level, ErrBudgetExceeded.Error(), c.budget.Used(), c.budget.Limit()))
+	close(item.status)
+	return false
+}
+
+// push will add the item to the queue, when the queue is full
+// the least severe item is dropped (which can be the given item)
+func (c *connQueue) push(item *ConnQueueItem) {
+	if item.trace != "" {
+		c.logger.Debug(logf(item.logFields(logFields{"remote": c.name}), "[%X] message has trace id '%s'", item.id, item.trace))
+	}
+	if !c.admit(item) {
+		return
+	}
+	if dropped := c.queue.push(item); dropped != nil {
+		dropped.error = append(dropped.error, ErrQueueFull)
+		dropped.shed = true
+		c.dropLogger(dropped)(logf(dropped.logFields(logFields{"remote": c.name, "level": dropped.level, "error": ErrQueueFull.Error()}), "[%X] dropped message with level %d, %s", dropped.id, dropped.level, ErrQueueFull.Error()))
+		c.discarded(dropped, "queue_full")
+	}
+}
+
+// requeue will add the item for a retry, when the queue
+// is closed the item is discarded
+func (c *connQueue) requeue(item *ConnQueueItem) {
+	if !c.queue.requeue(item) {
+		c.logger.Alert(logf(item.logFields(logFields{"remote": c.name, "tries": item.tries}), "[%X] discarded message after %d retires, queue is closed", item.id, item.tries))
+		c.discarded(item, "closed")
+		return
+	}
+	c.retried()
+}
+
+// retried will count a failed delivery that is tried again
+func (c *connQueue) retried() {
+	metricRetries.Inc(c.name)
+	atomic.AddUint64(&c.state.retried, 1)
+}
+
+// next will block till there is an item in the queue and
+// returns false when the queue is closed and empty
+func (c *connQueue) next() (*ConnQueueItem, bool) {
+	return c.queue.pop(nil)
+}
+
+// failure will record the error of a failed delivery
+func (c *connQueue) failure(item *ConnQueueItem, err error) {
+	item.tries++
+	item.error = append(item.error, err)
+	c.state.failure(err)
+}
+
+// Pause will stop delivering messages, new messages are
+// queued (and dropped when full) till the pool is resumed
+func (c *connQueue) Pause() {
+	atomic.StoreInt32(&c.paused, 1)
+	c.queue.pause(true)
+	c.logger.Notice(logf(logFields{"remote": c.name}, "paused delivering messages to '%s'", c.name))
+}
+
+// Resume will continue delivering the queued messages
+func (c *connQueue) Resume() {
+	atomic.StoreInt32(&c.paused, 0)
+	c.queue.pause(false)
+	c.logger.Notice(logf(logFields{"remote": c.name}, "resumed delivering messages to '%s'", c.name))
+}
+
+// Flush will write the collected messages without waiting for the flush
+// delay and blocks till the queue is empty or the context is done.
+func (c *connQueue) Flush(ctx context.Context) error {
+	if atomic.LoadInt32(&c.paused) == 1 {
+		return ErrPaused
+	}
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		c.queue.flush()
+		if c.queue.Len() == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Drain will close the queue so no new messages are accepted and blocks
+// till the workers delivered (or discarded) the queued messages or the
+// context is done. Paused pools are drained as well.
+func (c *connQueue) Drain(ctx context.Context) error {
+	c.queue.close()
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// State returns the connection and queue state of the pool
+func (c *connQueue) State() PoolState {
+	state := PoolState{
+		Remote:    c.name,
+		Halted:    atomic.LoadInt32(&c.halted) == 1,
+		Paused:    atomic.LoadInt32(&c.paused) == 1,
+		Queued:    c.queue.Len(),
+		QueueSize: c.queue.max,
+		Levels:    c.queue.counts(),
+	}
+	c.state.state(&state)
+	return state
 }
 
 func (c *connQueue) Push(d []byte, id []byte) *ConnQueueItem {
 	data := c.newQueueItem(d, id)
-	c.queue <- data
+	c.push(data)
+	return data
+}
+
+// PushInternal will queue a message that is created by the proxy
+// itself so it is not counted as a delivered (received) message
+func (c *connQueue) PushInternal(d []byte, id []byte) *ConnQueueItem {
+	data := c.newQueueItem(d, id)
+	data.internal = true
+	c.push(data)
 	return data
 }
 
 func (c *connQueue) Write(d []byte) (int, error) {
 	data := c.newQueueItem(d, nil)
-	c.queue <- data
+	c.push(data)
 	<-data.status
+	if data.shed {
+		return 0, data.error[len(data.error)-1]
+	}
 	return len(d), nil
 }
@@ -1,6 +1,7 @@
 package net
 
 import (
+	"context"
 	"net"
 	"time"
 
@@ -8,12 +9,12 @@ import (
 )
 
 type TcpConnPool struct {
-	address *net.TCPAddr
+	host *GraylogHost
 	connPool
 }
 
 func (c *TcpConnPool) bind(conn *net.Conn) (err error) {
-	*conn, err = net.DialTCP("tcp", nil, c.address)
+	*conn, err = c.dialer().Dial(c.host.GetNetwork(), c.host.GetHost())
 	return
 }
 
@@ -23,21 +24,41 @@ func (c *TcpConnPool) Start(workers int) {
 	c.start(workers, c.bind)
 }
 
-func NewTcpConnPool(tries int, host *GraylogHost, logger *logger.Logger) (ConnPoolInterface, error) {
-	if address, err := net.ResolveTCPAddr(host.GetNetwork(), host.GetHost()); err != nil {
-		return nil, err
-	} else {
-		return &TcpConnPool{
-			address: address,
-			connPool: connPool{
-				KeepAlive: 3 * time.Minute,
-				Timeout:   1 * time.Minute,
-				logger:    logger,
-				connQueue: connQueue{
-					tries: tries,
-					queue: make(chan *ConnQueueItem, 10),
-				},
+func NewTcpConnPool(tries int, host *GraylogHost, options *ConnOptions, logger *logger.Logger) (ConnPoolInterface, error) {
+	pool := &TcpConnPool{
+		host: host,
+		connPool: connPool{
+			KeepAlive:    3 * time.Minute,
+			Timeout:      1 * time.Minute,
+			WriteTimeout: options.WriteTimeout,
+			MaxAge:       options.MaxAge,
+			FlushSize:    options.FlushSize,
+			FlushDelay:   options.FlushDelay,
+			proxy:        options.Proxy,
+			resolver:     NewResolver(options.ResolveInterval, logger),
+			connQueue: connQueue{
+				tries:  tries,
+				name:   host.String(),
+				queue:  newPriorityQueue(queueSize(options)),
+				logger: logger,
+				budget: options.Budget,
 			},
-		}, nil
+		},
 	}
+	// the name is resolved by the proxy because it might
+	// not be resolvable from this host, else we check
+	// it here so we fail early on an invalid host.
+	if options.Proxy == nil {
+		name, _, err := net.SplitHostPort(host.GetHost())
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(name) == nil {
+			if _, err := pool.resolver.Lookup(context.Background(), name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	pool.register()
+	return pool, nil
 }
@@ -1,10 +1,7 @@
 package net
 
 import (
-	"crypto/tls"
 	"crypto/x509"
-	"fmt"
-	"io/ioutil"
 	"net"
 	"time"
 
@@ -13,52 +10,62 @@ import (
 
 type TcpTlsConnPool struct {
 	address *GraylogHost
-	config  *tls.Config
+	tls     *TlsLoader
 	connPool
 }
 
 func (c *TcpTlsConnPool) bind(conn *net.Conn) (err error) {
-	dialer := new(net.Dialer)
-	dialer.KeepAlive = c.KeepAlive
-	dialer.Timeout = c.Timeout
-	*conn, err = tls.DialWithDialer(dialer, c.address.GetNetwork(), c.address.GetHost(), c.config)
+	host, _, err := net.SplitHostPort(c.address.GetHost())
+	if err != nil {
+		return err
+	}
+	*conn, err = c.dialer().DialTls(c.address.GetNetwork(), c.address.GetHost(), c.tls.Config(host))
 	return
 }
 
+// Reload will reload the certificates used for new connections
+func (c *TcpTlsConnPool) Reload() error {
+	return c.tls.Reload()
+}
+
+// Certificate returns the client certificate used for new connections
+func (c *TcpTlsConnPool) Certificate() *x509.Certificate {
+	return c.tls.Certificate()
+}
+
+func (c *TcpTlsConnPool) Close() {
+	c.tls.Close()
+	c.connPool.Close()
+}
+
 func (c *TcpTlsConnPool) Start(workers int) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	c.start(workers, c.bind)
 }
 
-func NewTcpTlsConnPool(tries int, address *GraylogHost, ca, crt, pem string, logger *logger.Logger) (ConnPoolInterface, error) {
-	buf, err := ioutil.ReadFile(ca)
-	if err != nil {
-		return nil, err
-	}
-	logger.Debug(fmt.Sprintf("loaded ca root certificate: '%s'", ca))
-	certPool := x509.NewCertPool()
-	certPool.AppendCertsFromPEM(buf)
-	pair, err := tls.LoadX509KeyPair(crt, pem)
-	if err != nil {
-		return nil, err
-	}
-	logger.Debug(fmt.Sprintf("loaded certificate: '%s'", crt))
-	logger.Debug(fmt.Sprintf("loaded private key: '%s'", pem))
-	return &TcpTlsConnPool{
+func NewTcpTlsConnPool(tries int, address *GraylogHost, loader *TlsLoader, options *ConnOptions, logger *logger.Logger) (ConnPoolInterface, error) {
+	pool := &TcpTlsConnPool{
 		address: address,
-		config: &tls.Config{
-			RootCAs:      certPool,
-			Certificates: []tls.Certificate{pair},
-		},
+		tls:     loader,
 		connPool: connPool{
-			KeepAlive: 3 * time.Minute,
-			Timeout:   1 * time.Minute,
-			logger:    logger,
+			KeepAlive:    3 * time.Minute,
+			Timeout:      1 * time.Minute,
+			WriteTimeout: options.WriteTimeout,
+			MaxAge:       options.MaxAge,
+			FlushSize:    options.FlushSize,
+			FlushDelay:   options.FlushDelay,
+			proxy:        options.Proxy,
+			resolver:     NewResolver(options.ResolveInterval, logger),
 			connQueue: connQueue{
-				tries: tries,
-				queue: make(chan *ConnQueueItem, 10),
+				tries:  tries,
+				name:   address.String(),
+				queue:  newPriorityQueue(queueSize(options)),
+				logger: logger,
+				budget: options.Budget,
 			},
 		},
-	}, nil
+	}
+	pool.register()
+	return pool, nil
 }
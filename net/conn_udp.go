@@ -0,0 +1,132 @@
+package net
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/pbergman/logger"
+)
+
+// UdpConnPool will send the messages as (chunked) GELF
+// udp datagrams so it can be used to feed a graylog udp
+// input or another proxy.
+type UdpConnPool struct {
+	connQueue
+	conn        net.Conn
+	address     *GraylogHost
+	compression Compression
+	chunkSize   int
+}
+
+func (c *UdpConnPool) Close() {
+	c.close()
+	c.conn.Close()
+}
+
+func (c *UdpConnPool) Start(workers int) {
+	for i := 0; i < workers; i++ {
+		c.wg.Add(1)
+		go c.process(&c.wg)
+	}
+}
+
+// encode will create the datagrams for the given message, the
+// trailing delimiter that is used for stream inputs is removed
+// because a udp message is delimited by the datagram itself.
+func (c *UdpConnPool) encode(data []byte) ([][]byte, error) {
+	if size := len(data); size > 0 && (data[size-1] == 0 || data[size-1] == '\n') {
+		data = data[:size-1]
+	}
+	payload, err := c.compression.compress(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) <= c.chunkSize {
+		return [][]byte{payload}, nil
+	}
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	return newChunks(id, payload, c.chunkSize)
+}
+
+func (c *UdpConnPool) write(item *ConnQueueItem) error {
+	datagrams, err := c.encode(item.data)
+	if err != nil {
+		return err
+	}
+	var size int
+	for _, datagram := range datagrams {
+		n, err := c.conn.Write(datagram)
+		size += n
+		if err != nil {
+			return err
+		}
+	}
+	c.logger.Info(logf(item.logFields(logFields{"remote": c.name, "bytes": size, "datagrams": len(datagrams)}), "[%X] written %d bytes in %d datagram(s) to '%s'", item.id, size, len(datagrams), c.conn.RemoteAddr().String()))
+	return nil
+}
+
+func (c *UdpConnPool) process(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		item, ok := c.next()
+		if !ok {
+			break
+		}
+		if c.discard(item) {
+			continue
+		}
+		if err := c.write(item); err != nil {
+			c.failure(item, err)
+			c.logger.Error(logf(item.logFields(logFields{"remote": c.name, "error": err.Error()}), "[%X] %s", item.id, err.Error()))
+			if item.tries < c.tries {
+				c.requeue(item)
+			} else {
+				c.logger.Alert(logf(item.logFields(logFields{"remote": c.name, "tries": item.tries}), "[%X] discarded message after %d retires", item.id, item.tries))
+				c.discarded(item, "retries")
+			}
+		} else {
+			c.delivered(item)
+		}
+	}
+}
+
+func NewUdpConnPool(tries int, address *GraylogHost, options *ConnOptions, logger *logger.Logger) (ConnPoolInterface, error) {
+	pool := &UdpConnPool{
+		address:     address,
+		compression: CompressionGzip,
+		chunkSize:   ChunkSizeLan,
+		connQueue: connQueue{
+			tries:  tries,
+			name:   address.String(),
+			queue:  newPriorityQueue(queueSize(options)),
+			logger: logger,
+		},
+	}
+	if options != nil {
+		if options.Proxy != nil {
+			return nil, errors.New("a proxy can not be used for udp remotes")
+		}
+		if options.Compression != "" {
+			pool.compression = options.Compression
+		}
+		pool.budget = options.Budget
+		if options.ChunkSize > 0 {
+			pool.chunkSize = options.ChunkSize
+		}
+	}
+	conn, err := net.Dial(address.GetNetwork(), address.GetHost())
+	if err != nil {
+		return nil, err
+	}
+	// udp is connectionless so the socket is the connection
+	pool.conn = pool.state.track(conn)
+	pool.register()
+	logger.Debug(fmt.Sprintf("using compression '%s' and chunk size %d", pool.compression, pool.chunkSize))
+	return pool, nil
+}
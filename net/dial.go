@@ -0,0 +1,387 @@
+package net
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Dialer creates the connections to the remote, directly or
+// through a http (CONNECT) or socks5 proxy when Proxy is set.
+type Dialer struct {
+	net.Dialer
+	// Proxy is the url of the upstream proxy, the scheme
+	// should be http or socks5 and can contain credentials
+	Proxy *url.URL
+	// Resolver is used (when set) to resolve the host of the remote
+	// so all addresses can be tried, it is not used with a proxy
+	// because the proxy will resolve the host.
+	Resolver *Resolver
+	// Remote is used as label for the dial metrics
+	Remote string
+}
+
+// NewProxyUrl will parse and validate the given proxy url
+func NewProxyUrl(raw string) (*url.URL, error) {
+	proxy, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch proxy.Scheme {
+	case "http", "socks5", "socks5h":
+	default:
+		return nil, errors.New("unsupported proxy scheme '" + proxy.Scheme + "', expected http or socks5")
+	}
+	if proxy.Hostname() == "" {
+		return nil, errors.New("missing host for proxy '" + proxy.Redacted() + "'")
+	}
+	return proxy, nil
+}
+
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext will connect to the given address directly or through the proxy
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.dial(ctx, network, address)
+	if err != nil {
+		metricDialErrors.Inc(d.Remote)
+		return nil, err
+	}
+	metricDials.Inc(d.Remote)
+	return conn, nil
+}
+
+func (d *Dialer) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.Proxy == nil {
+		if d.Resolver != nil {
+			return d.dialResolved(ctx, network, address)
+		}
+		return d.Dialer.DialContext(ctx, network, address)
+	}
+	conn, err := d.Dialer.DialContext(ctx, "tcp", d.proxyAddress())
+	if err != nil {
+		return nil, err
+	}
+	// make sure the handshake with the proxy
+	// will not hang when the proxy is not responding
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else if d.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(d.Timeout))
+	}
+	var tunnel = conn
+	switch d.Proxy.Scheme {
+	case "http":
+		tunnel, err = d.connect(conn, address)
+	default:
+		err = d.socks5(conn, address)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %s", d.Proxy.Redacted(), err.Error())
+	}
+	conn.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+// DialTls will create a tls connection to the given address, the tls session
+// is created over the (proxied) connection so it is end-to-end with the remote.
+func (d *Dialer) DialTls(network, address string, config *tls.Config) (net.Conn, error) {
+	return d.DialTlsContext(context.Background(), network, address, config)
+}
+
+// DialTlsContext is the same as DialTls with the given context
+func (d *Dialer) DialTlsContext(ctx context.Context, network, address string, config *tls.Config) (net.Conn, error) {
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+	if d.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(d.Timeout))
+	}
+	client := tls.Client(conn, config)
+	if err := client.HandshakeContext(ctx); err != nil {
+		metricTlsFailures.Inc(d.Remote)
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return client, nil
+}
+
+// dialResolved will resolve the host with the resolver and tries all returned
+// addresses, a new attempt is started when the previous failed or did not
+// connect within the fallback delay. The first connection that is made wins.
+func (d *Dialer) dialResolved(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return d.Dialer.DialContext(ctx, network, address)
+	}
+	addresses, err := d.Resolver.Lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if addresses = sortAddresses(network, addresses); len(addresses) == 0 {
+		return nil, fmt.Errorf("no %s addresses found for '%s'", network, host)
+	}
+	conn, err := d.dialAddresses(ctx, network, addresses, port)
+	if err != nil {
+		// the addresses could be changed so resolve again
+		// and retry when we got a different set of addresses
+		d.Resolver.Invalidate(host)
+		if retry, _ := d.Resolver.Lookup(ctx, host); len(retry) > 0 {
+			if retry = sortAddresses(network, retry); len(retry) > 0 && formatAddresses(retry) != formatAddresses(addresses) {
+				return d.dialAddresses(ctx, network, retry, port)
+			}
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (d *Dialer) dialAddresses(ctx context.Context, network string, addresses []net.IP, port string) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var results = make(chan result, len(addresses))
+	var next, pending int
+	var first error
+	start := func() {
+		address := net.JoinHostPort(addresses[next].String(), port)
+		next++
+		pending++
+		go func() {
+			conn, err := d.Dialer.DialContext(ctx, network, address)
+			results <- result{conn, err}
+		}()
+	}
+	delay := d.FallbackDelay
+	if delay <= 0 {
+		delay = 300 * time.Millisecond
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	start()
+	for pending > 0 {
+		select {
+		case ret := <-results:
+			pending--
+			if ret.err == nil {
+				// close the connections of the attempts that
+				// succeed before they are canceled
+				go func(pending int) {
+					for i := 0; i < pending; i++ {
+						if ret := <-results; ret.conn != nil {
+							ret.conn.Close()
+						}
+					}
+				}(pending)
+				return ret.conn, nil
+			}
+			if first == nil {
+				first = ret.err
+			}
+			if next < len(addresses) {
+				start()
+				timer.Reset(delay)
+			}
+		case <-timer.C:
+			if next < len(addresses) {
+				start()
+				timer.Reset(delay)
+			}
+		}
+	}
+	return nil, first
+}
+
+func (d *Dialer) proxyAddress() string {
+	if port := d.Proxy.Port(); port != "" {
+		return d.Proxy.Host
+	}
+	if d.Proxy.Scheme == "http" {
+		return net.JoinHostPort(d.Proxy.Hostname(), "80")
+	}
+	return net.JoinHostPort(d.Proxy.Hostname(), "1080")
+}
+
+// bufferedConn is used to not lose the data that
+// was read ahead by the reader of the proxy response
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
+
+// connect will create a tunnel with the http CONNECT method
+func (d *Dialer) connect(conn net.Conn, address string) (net.Conn, error) {
+	request := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if user := d.Proxy.User; user != nil {
+		password, _ := user.Password()
+		request.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)))
+	}
+	if err := request.Write(conn); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	// the body is not read or closed because on success
+	// the remaining data belongs to the tunneled connection
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New("CONNECT " + address + " failed: " + response.Status)
+	}
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+var socks5Errors = []string{
+	"",
+	"general SOCKS server failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+// socks5 will do the socks5 handshake (RFC 1928) with
+// optional username/password authentication (RFC 1929)
+func (d *Dialer) socks5(conn net.Conn, address string) error {
+	host, rawPort, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(rawPort)
+	if err != nil {
+		return errors.New("invalid port '" + rawPort + "'")
+	}
+	methods := []byte{0x00}
+	if d.Proxy.User != nil {
+		methods = append(methods, 0x02)
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if buf[0] != 0x05 {
+		return fmt.Errorf("unexpected socks version %d", buf[0])
+	}
+	switch buf[1] {
+	case 0x00:
+	case 0x02:
+		if d.Proxy.User == nil {
+			return errors.New("proxy requires authentication")
+		}
+		user := d.Proxy.User.Username()
+		password, _ := d.Proxy.User.Password()
+		if len(user) > 255 || len(password) > 255 {
+			return errors.New("username or password too long")
+		}
+		auth := []byte{0x01, byte(len(user))}
+		auth = append(auth, user...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return err
+		}
+		if buf[1] != 0x00 {
+			return errors.New("authentication failed")
+		}
+	default:
+		return errors.New("no acceptable authentication method")
+	}
+	request := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("host name too long")
+		}
+		request = append(request, 0x03, byte(len(host)))
+		request = append(request, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(request, 0x01)
+		request = append(request, ip4...)
+	} else {
+		request = append(request, 0x04)
+		request = append(request, ip.To16()...)
+	}
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0x00 {
+		if int(reply[1]) < len(socks5Errors) {
+			return errors.New(socks5Errors[reply[1]])
+		}
+		return fmt.Errorf("unknown socks error %d", reply[1])
+	}
+	// read the bound address and port that
+	// we don't need but should be consumed
+	var size int
+	switch reply[3] {
+	case 0x01:
+		size = net.IPv4len
+	case 0x04:
+		size = net.IPv6len
+	case 0x03:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return err
+		}
+		size = int(buf[0])
+	default:
+		return fmt.Errorf("unknown address type %d", reply[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, size+2))
+	return err
+}
@@ -0,0 +1,149 @@
+package net
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+// newTestEchoServer starts a tcp server that echos the first line
+func newTestEchoServer(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			line, _ := bufio.NewReader(conn).ReadBytes('\n')
+			conn.Write(line)
+			conn.Close()
+		}
+	}()
+	return listener
+}
+
+// newTestConnectProxy starts a http proxy that only supports CONNECT
+func newTestConnectProxy(t *testing.T, auth string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" || r.Header.Get("Proxy-Authorization") != auth {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		remote, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		conn, buf, _ := w.(http.Hijacker).Hijack()
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go io.Copy(remote, buf)
+		io.Copy(conn, remote)
+		conn.Close()
+	}))
+	return listener
+}
+
+// newTestSocks5Proxy starts a socks5 proxy that requires the given user and password
+func newTestSocks5Proxy(t *testing.T, user, password string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := func(r io.Reader, n int) []byte {
+		buf := make([]byte, n)
+		io.ReadFull(r, buf)
+		return buf
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			read(conn, int(read(conn, 2)[1]))
+			conn.Write([]byte{0x05, 0x02})
+			u := string(read(conn, int(read(conn, 2)[1])))
+			p := string(read(conn, int(read(conn, 1)[0])))
+			if u != user || p != password {
+				conn.Write([]byte{0x01, 0x01})
+				conn.Close()
+				continue
+			}
+			conn.Write([]byte{0x01, 0x00})
+			var host string
+			switch read(conn, 4)[3] {
+			case 0x01:
+				host = net.IP(read(conn, 4)).String()
+			case 0x03:
+				host = string(read(conn, int(read(conn, 1)[0])))
+			}
+			port := binary.BigEndian.Uint16(read(conn, 2))
+			remote, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+			if err != nil {
+				conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+				conn.Close()
+				continue
+			}
+			conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+			go io.Copy(remote, conn)
+			go func(conn net.Conn) { io.Copy(conn, remote); conn.Close() }(conn)
+		}
+	}()
+	return listener
+}
+
+func assertDialEcho(t *testing.T, dialer *Dialer, address string) {
+	conn, err := dialer.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "hello\n" {
+		t.Fatalf("expected 'hello' to be echoed got %q (%v)", line, err)
+	}
+}
+
+func TestDialer_connect(t *testing.T) {
+	echo := newTestEchoServer(t)
+	defer echo.Close()
+	proxy := newTestConnectProxy(t, "Basic dXNlcjpzZWNyZXQ=")
+	defer proxy.Close()
+	dialer := &Dialer{Proxy: &url.URL{Scheme: "http", Host: proxy.Addr().String(), User: url.UserPassword("user", "secret")}}
+	assertDialEcho(t, dialer, echo.Addr().String())
+	dialer.Proxy.User = url.UserPassword("user", "invalid")
+	if _, err := dialer.Dial("tcp", echo.Addr().String()); err == nil {
+		t.Fatal("expected an error for invalid credentials")
+	}
+}
+
+func TestDialer_socks5(t *testing.T) {
+	echo := newTestEchoServer(t)
+	defer echo.Close()
+	proxy := newTestSocks5Proxy(t, "user", "secret")
+	defer proxy.Close()
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+	dialer := &Dialer{Proxy: &url.URL{Scheme: "socks5", Host: proxy.Addr().String(), User: url.UserPassword("user", "secret")}}
+	assertDialEcho(t, dialer, echo.Addr().String())
+	assertDialEcho(t, dialer, net.JoinHostPort("localhost", port))
+	dialer.Proxy.User = url.UserPassword("user", "invalid")
+	if _, err := dialer.Dial("tcp", echo.Addr().String()); err == nil {
+		t.Fatal("expected an error for invalid credentials")
+	}
+}
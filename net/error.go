@@ -1,5 +1,28 @@
 package net
 
+import (
+	"errors"
+	"strings"
+)
+
+// ErrQueueFull is set on queue items that are dropped because
+// the queue was full with more severe messages
+var ErrQueueFull = errors.New("queue is full")
+
+// ErrPaused is returned when flushing a pool that is paused
+var ErrPaused = errors.New("delivering messages is paused")
+
+// StatusError is returned when the remote responded with a status
+// other than 2xx, so the message is tried again or discarded
+type StatusError struct {
+	Code   int
+	Status string
+}
+
+func (s *StatusError) Error() string {
+	return "unexpected response status '" + s.Status + "'"
+}
+
 type FatalError struct {
 	e error
 }
@@ -7,3 +30,19 @@ type FatalError struct {
 func (f *FatalError) Error() string {
 	return f.e.Error()
 }
+
+func (f *FatalError) Unwrap() error {
+	return f.e
+}
+
+// PinError is returned when none of the certificates
+// of the remote match one of the configured pins
+type PinError struct {
+	// Hashes holds the (base64 encoded) SPKI SHA-256
+	// hashes of the certificates the remote provided
+	Hashes []string
+}
+
+func (p *PinError) Error() string {
+	return "tls: certificate pin mismatch, remote provided certificate(s) with public key hash: sha256/" + strings.Join(p.Hashes, ", sha256/")
+}
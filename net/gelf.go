@@ -0,0 +1,168 @@
+package net
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+const (
+	// ChunkSizeWan is the max payload size of a chunk that is
+	// safe to use when the messages are send over a wan
+	ChunkSizeWan = 1420
+	// ChunkSizeLan is the max payload size of a chunk that can
+	// be used when the messages are send over a lan
+	ChunkSizeLan = 8154
+	// the max amount of chunks a message can be split in, see
+	// http://docs.graylog.org/en/2.3/pages/gelf.html#chunking
+	maxChunks = 128
+	// LevelCritical is the (syslog) level of critical messages,
+	// messages with this level or lower (more severe) are never
+	// dropped by the memory budget or a full queue
+	LevelCritical = 2
+	// LevelDebug is the least severe (syslog) level, messages that
+	// can not be parsed get this level so these are shed first
+	LevelDebug = 7
+)
+
+// Compression is the algorithm used for compressing GELF
+// messages before they are send over udp
+type Compression string
+
+const (
+	CompressionNone Compression = "none"
+	CompressionGzip Compression = "gzip"
+	CompressionZlib Compression = "zlib"
+)
+
+// NewCompression will validate the given name and returns the
+// matching compression, an empty string will default to gzip
+func NewCompression(name string) (Compression, error) {
+	switch c := Compression(name); c {
+	case "":
+		return CompressionGzip, nil
+	case CompressionNone, CompressionGzip, CompressionZlib:
+		return c, nil
+	default:
+		return "", errors.New("unsupported compression '" + name + "', expected gzip, zlib or none")
+	}
+}
+
+func (c Compression) compress(b []byte) ([]byte, error) {
+	var writer io.WriteCloser
+	var buf = new(bytes.Buffer)
+	switch c {
+	case CompressionGzip:
+		writer = gzip.NewWriter(buf)
+	case CompressionZlib:
+		writer = zlib.NewWriter(buf)
+	default:
+		return b, nil
+	}
+	if _, err := writer.Write(b); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// newChunks will split the given payload in GELF chunks of the given
+// size where every chunk is prefixed with the magic bytes (0x1e 0x0f),
+// the message id, sequence number and sequence count.
+func newChunks(id [8]byte, b []byte, size int) ([][]byte, error) {
+	count := (len(b) + size - 1) / size
+	if count > maxChunks {
+		return nil, fmt.Errorf("message of %d bytes exceeds the max of %d chunks", len(b), maxChunks)
+	}
+	chunks := make([][]byte, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * size
+		if end > len(b) {
+			end = len(b)
+		}
+		chunk := make([]byte, 0, 12+end-(i*size))
+		chunk = append(chunk, 0x1e, 0x0f)
+		chunk = append(chunk, id[:]...)
+		chunk = append(chunk, byte(i), byte(count))
+		chunks[i] = append(chunk, b[i*size:end]...)
+	}
+	return chunks, nil
+}
+
+// gelfLevel returns the (syslog) level of the given GELF message, the
+// default of 1 (alert) is returned for a message without a valid level
+// and LevelDebug for a message that can not be parsed.
+func gelfLevel(b []byte) int {
+	level, _ := gelfFields(b)
+	return level
+}
+
+// gelfFields returns the (syslog) level and the _trace_id field of the
+// given GELF message, see gelfLevel for the default level.
+func gelfFields(b []byte) (int, string) {
+	if size := len(b); size > 0 && (b[size-1] == 0 || b[size-1] == '\n') {
+		b = b[:size-1]
+	}
+	var message struct {
+		Level interface{} `json:"level"`
+		Trace interface{} `json:"_trace_id"`
+	}
+	if err := json.Unmarshal(b, &message); err != nil {
+		return LevelDebug, ""
+	}
+	var trace string
+	if message.Trace != nil {
+		trace = fmt.Sprint(message.Trace)
+	}
+	switch level := message.Level.(type) {
+	case float64:
+		return int(level), trace
+	case string:
+		if value, err := strconv.Atoi(level); err == nil {
+			return value, trace
+		}
+	}
+	return 1, trace
+}
+
+// MessageIdField is the GELF field the proxy message id is injected
+// as (see ListenerOptions.InjectId) and that the forwarded logs refer to
+const MessageIdField = "_proxy_msg_id"
+
+// newMessageId creates the id that is used for a message from the
+// moment it is received till it is delivered (or discarded)
+func newMessageId() []byte {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		binary.BigEndian.PutUint64(id, uint64(time.Now().UnixNano()))
+	}
+	return id
+}
+
+// injectField will add the field to the given GELF (JSON) message, the
+// message is returned unchanged when it is not a JSON object or when
+// it already has the field (like a message that passed another proxy).
+func injectField(b []byte, name, value string) []byte {
+	trimmed := bytes.TrimLeft(b, " \t\r\n")
+	if len(trimmed) == 0 || trimmed[0] != '{' || bytes.Contains(b, []byte(`"`+name+`"`)) {
+		return b
+	}
+	field, _ := json.Marshal(map[string]string{name: value})
+	rest := bytes.TrimLeft(trimmed[1:], " \t\r\n")
+	out := make([]byte, 0, len(b)+len(field))
+	out = append(out, field[:len(field)-1]...)
+	if len(rest) > 0 && rest[0] != '}' {
+		out = append(out, ',')
+	}
+	return append(out, rest...)
+}
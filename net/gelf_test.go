@@ -0,0 +1,98 @@
+package net
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/pbergman/logger"
+)
+
+func TestNewChunks(t *testing.T) {
+	id := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	payload := bytes.Repeat([]byte("0123456789"), 25)
+	chunks, err := newChunks(id, payload, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := len(chunks); s != 3 {
+		t.Fatalf("expected 3 chunks got %d", s)
+	}
+	var merged []byte
+	for i, chunk := range chunks {
+		if chunk[0] != 0x1e || chunk[1] != 0x0f {
+			t.Fatalf("expected chunk %d to start with the magic bytes got %X", i, chunk[:2])
+		}
+		if !bytes.Equal(chunk[2:10], id[:]) {
+			t.Fatalf("expected chunk %d to have id %X got %X", i, id, chunk[2:10])
+		}
+		if int(chunk[10]) != i || chunk[11] != 3 {
+			t.Fatalf("expected chunk sequence %d/3 got %d/%d", i, chunk[10], chunk[11])
+		}
+		merged = append(merged, chunk[12:]...)
+	}
+	if !bytes.Equal(merged, payload) {
+		t.Fatalf("expected merged chunks to match the payload")
+	}
+	if _, err := newChunks(id, payload, 1); err == nil {
+		t.Fatal("expected an error for exceeding the max chunks")
+	}
+}
+
+func TestUdpConnPool_encode(t *testing.T) {
+	for _, compression := range []Compression{CompressionNone, CompressionGzip, CompressionZlib} {
+		listener, err := NewListener("udp://127.0.0.1:0", logger.NewLogger("test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool := &UdpConnPool{compression: compression, chunkSize: 64}
+		message := bytes.Repeat([]byte(`{"short_message":"test"}`), 20)
+		datagrams, err := pool.encode(append(message, byte(0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, datagram := range datagrams {
+			listener.parse(datagram, make([]byte, 8), "")
+		}
+		select {
+		case ret := <-listener.Done:
+			if out, ok := ret.([]byte); !ok || !bytes.Equal(out[8:], message) {
+				t.Fatalf("[%s] expected decoded message to match got %v", compression, ret)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("[%s] timeout waiting for message", compression)
+		}
+	}
+}
+
+func TestGelfFields(t *testing.T) {
+	for message, expected := range map[string]struct {
+		level int
+		trace string
+	}{
+		`{"level":3,"_trace_id":"abc"}`:  {3, "abc"},
+		`{"level":"6","_trace_id":1234}`: {6, "1234"},
+		"{\"level\":4}\x00":              {4, ""},
+		`{"short_message":"no level"}`:   {1, ""},
+		`not json`:                       {LevelDebug, ""},
+		`["not","an","object"]`:          {LevelDebug, ""},
+	} {
+		if level, trace := gelfFields([]byte(message)); level != expected.level || trace != expected.trace {
+			t.Fatalf("expected level %d and trace '%s' for %s got %d and '%s'", expected.level, expected.trace, message, level, trace)
+		}
+	}
+}
+
+func TestInjectField(t *testing.T) {
+	for message, expected := range map[string]string{
+		`{"version":"1.1"}`:                `{"_proxy_msg_id":"0A","version":"1.1"}`,
+		` { "version":"1.1"}`:              `{"_proxy_msg_id":"0A","version":"1.1"}`,
+		`{}`:                               `{"_proxy_msg_id":"0A"}`,
+		`{"_proxy_msg_id":"FF","level":1}`: `{"_proxy_msg_id":"FF","level":1}`,
+		`["not","an","object"]`:            `["not","an","object"]`,
+	} {
+		if out := injectField([]byte(message), MessageIdField, "0A"); string(out) != expected {
+			t.Fatalf("expected %s for %s got %s", expected, message, out)
+		}
+	}
+}
@@ -27,12 +27,12 @@ func (g GraylogHost) IsSecure() bool {
 }
 
 func NewGraylogHost(host string) *GraylogHost {
-	pattern := regexp.MustCompile(`^(?:(tcp(?:4|6)?(?:\+(?:ssl|tls))?|https?):\/\/)(.*)$`)
+	pattern := regexp.MustCompile(`^(?:(tcp(?:4|6)?(?:\+(?:ssl|tls))?|udp(?:4|6)?|https?):\/\/)(.*)$`)
 	if pattern.MatchString(host) {
 		info := pattern.FindStringSubmatch(host)
 		var network string
 		var secure bool
-		if info[1][:3] == "tcp" {
+		if prefix := info[1][:3]; prefix == "tcp" || prefix == "udp" {
 			if 3 == len(info[1]) {
 				network = info[1]
 			} else if '+' == info[1][3] {
@@ -40,7 +40,7 @@ func NewGraylogHost(host string) *GraylogHost {
 				secure = true
 			} else {
 				network = info[1][:4]
-				if '+' == info[1][4] {
+				if len(info[1]) > 4 && '+' == info[1][4] {
 					secure = true
 				}
 			}
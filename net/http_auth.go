@@ -0,0 +1,78 @@
+package net
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Secret is a string that will be masked when formatted
+// so that it will not end up in the log output
+type Secret string
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return "******"
+}
+
+func (s Secret) GoString() string {
+	return `"` + s.String() + `"`
+}
+
+// ReadSecretFile will read the secret from the given file, leading
+// and trailing white spaces (like the new line) will be removed.
+func ReadSecretFile(name string) (Secret, error) {
+	buf, err := ioutil.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	if secret := strings.TrimSpace(string(buf)); secret != "" {
+		return Secret(secret), nil
+	}
+	return "", errors.New("no secret found in file '" + name + "'")
+}
+
+// ReadSecretEnv will read the secret from the given environment variable
+func ReadSecretEnv(name string) (Secret, error) {
+	if secret, ok := os.LookupEnv(name); ok && secret != "" {
+		return Secret(secret), nil
+	}
+	return "", errors.New("environment variable '" + name + "' is not set or empty")
+}
+
+// HttpAuth holds the credentials used to authenticate on the
+// remote, when a token is set it will be used as bearer token
+// else the user and password are used for basic authentication.
+type HttpAuth struct {
+	User     string
+	Password Secret
+	Token    Secret
+}
+
+func (a *HttpAuth) String() string {
+	switch {
+	case a == nil:
+		return "none"
+	case a.Token != "":
+		return "bearer"
+	case a.User != "":
+		return "basic (" + a.User + ")"
+	default:
+		return "none"
+	}
+}
+
+func (a *HttpAuth) apply(request *http.Request) {
+	switch {
+	case a == nil:
+		return
+	case a.Token != "":
+		request.Header.Set("Authorization", "Bearer "+string(a.Token))
+	case a.User != "":
+		request.SetBasicAuth(a.User, string(a.Password))
+	}
+}
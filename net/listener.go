@@ -4,14 +4,13 @@ import (
 	"bytes"
 	"compress/gzip"
 	"compress/zlib"
-	"crypto/sha1"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"regexp"
 	"sync"
-	"time"
+	"sync/atomic"
 
 	"github.com/pbergman/logger"
 )
@@ -21,6 +20,20 @@ var (
 	dsnPattern = regexp.MustCompile(`^(udp[4|6]?|unixgram|ip[4|6]?:[^:]+)://([^$]+)$`)
 )
 
+// ListenerOptions are the settings of a listener that
+// can be changed while the listener is receiving
+type ListenerOptions struct {
+	// RateLimiter is used (when set) to drop the messages
+	// of sources that exceed the configured limits
+	RateLimiter *RateLimiter
+	// AccessList is used (when set) to reject the
+	// packets from sources that are not allowed
+	AccessList *AccessList
+	// InjectId will add the message id as the
+	// _proxy_msg_id field to the GELF messages
+	InjectId bool
+}
+
 type Listener struct {
 	network string
 	address string
@@ -30,82 +43,260 @@ type Listener struct {
 	log     *logger.Logger
 	queue   *sync.Map
 	Done    chan interface{}
+	// closing guards the Done channel so the goroutines that are
+	// still parsing do not send on it after the listener is closed
+	closing  sync.RWMutex
+	closed   bool
+	stopping int32
+	options  atomic.Value
+	// bound, received and dropped are reported by the health endpoints
+	bound    int32
+	received uint64
+	dropped  uint64
+	// Budget is the memory budget the received packets
+	// and chunks are accounted against (nil for no limit)
+	Budget *Budget
 }
 
-func (u *Listener) Close() error {
-	defer func() {
-		u.conn = nil
-	}()
+// String returns the address of the listener, this is also
+// used as label for the metrics
+func (u *Listener) String() string {
+	return u.network + "://" + u.address
+}
 
-	close(u.Done)
+// SetOptions will replace the options, the new options are used for the
+// packets that are received after this call. When the access list of the
+// new options needs the peer credentials these are enabled on a bound unix
+// socket, on error the current options are kept.
+func (u *Listener) SetOptions(options *ListenerOptions) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if conn, ok := u.conn.(*net.UnixConn); ok && options.AccessList.credentials() {
+		if err := enableCredentials(conn); err != nil {
+			return err
+		}
+	}
+	u.options.Store(options)
+	return nil
+}
+
+// Options returns the current options of the listener
+func (u *Listener) Options() *ListenerOptions {
+	if options, ok := u.options.Load().(*ListenerOptions); ok {
+		return options
+	}
+	return new(ListenerOptions)
+}
 
+// State returns the state of the listener
+func (u *Listener) State() ListenerState {
+	options := u.Options()
+	state := ListenerState{
+		Address:  u.String(),
+		Bound:    atomic.LoadInt32(&u.bound) == 1,
+		Received: atomic.LoadUint64(&u.received),
+		Dropped:  atomic.LoadUint64(&u.dropped),
+		Rejected: options.AccessList.Rejected(),
+	}
+	if options.RateLimiter != nil {
+		state.Limited, _ = options.RateLimiter.Dropped()
+	}
+	return state
+}
+
+// send will pass the value to the Done channel, the value
+// is ignored when the listener is closed
+func (u *Listener) send(v interface{}) {
+	u.closing.RLock()
+	defer u.closing.RUnlock()
+	if !u.closed {
+		u.Done <- v
+	}
+}
+
+// Close will close the socket and the Done channel, the Done channel
+// should be read till it is closed because the values that are still
+// sent by the parsing goroutines are waited for.
+func (u *Listener) Close() error {
+	atomic.StoreInt32(&u.stopping, 1)
+	u.lock.Lock()
+	var err error
 	if nil != u.conn {
-		return u.conn.Close()
-	} else {
-		return nil
+		err = u.conn.Close()
 	}
+	u.lock.Unlock()
+
+	u.closing.Lock()
+	defer u.closing.Unlock()
+
+	if !u.closed {
+		u.closed = true
+		atomic.StoreInt32(&u.bound, 0)
+		close(u.Done)
+	}
+
+	return err
+}
+
+// Bind will open the socket, this is done by Listen when it is not called
+// before so errors like an address that is in use can be handled first
+func (u *Listener) Bind() error {
+	return u.connect()
 }
 
 func (u *Listener) Listen() {
 	if err := u.connect(); err != nil {
-		u.Done <- &FatalError{err}
+		u.send(&FatalError{err})
 		return
 	}
+	buf := make([]byte, 8192)
 	for {
-		buf, id := make([]byte, 8192), make([]byte, 8, 8)
-		n, add, err := u.conn.ReadFrom(buf)
+		id := newMessageId()
+		n, add, peer, err := u.read(buf)
 
 		if err != nil {
-			u.Done <- err
-		} else if n < len(buf) {
-			u.createId(buf, id)
-			u.log.Debug(fmt.Sprintf("[%X] received %d bytes from '%s'", id, n, add.String()))
+			if atomic.LoadInt32(&u.stopping) == 1 {
+				return
+			}
+			metricDecodeErrors.Inc(u.String(), "read")
+			u.send(err)
+			continue
 		}
-		go u.parse(buf[:n], id)
+		atomic.AddUint64(&u.received, 1)
+		metricPacketsReceived.Inc(u.String())
+		metricBytesReceived.Add(uint64(n), u.String())
+		if !u.Options().AccessList.Allowed(add, peer) {
+			metricPacketsRejected.Inc(u.String())
+			u.log.Debug(logf(logFields{"listener": u.String(), "source": addressString(add, peer), "bytes": n}, "rejected packet of %d bytes from '%s'", n, addressString(add, peer)))
+			continue
+		}
+		if n < 2 {
+			u.log.Debug(logf(logFields{"listener": u.String(), "source": addressString(add, peer), "bytes": n}, "ignoring packet of %d bytes from '%s'", n, addressString(add, peer)))
+			continue
+		}
+		// only the received bytes are copied so a small message
+		// will not hold the full read buffer while it is parsed
+		if !u.admit(buf[:n]) {
+			atomic.AddUint64(&u.dropped, 1)
+			u.log.Warning(logf(logFields{"id": hexId(id), "listener": u.String(), "source": addressString(add, peer), "bytes": n, "error": ErrBudgetExceeded.Error()}, "[%X] dropped %d bytes from '%s', %s", id, n, addressString(add, peer), ErrBudgetExceeded.Error()))
+			continue
+		}
+		u.log.Debug(logf(logFields{"id": hexId(id), "listener": u.String(), "source": addressString(add, peer), "bytes": n}, "[%X] received %d bytes from '%s'", id, n, addressString(add, peer)))
+		data := make([]byte, n)
+		copy(data, buf)
+		go func() {
+			u.parse(data, id, addressString(add, peer))
+			u.Budget.Release(len(data))
+		}()
+	}
+}
+
+// admit will reserve the memory for a received packet, the level is used
+// for uncompressed messages so low severity messages are dropped first
+func (u *Listener) admit(b []byte) bool {
+	if b[0] == '{' {
+		return u.Budget.Admit(len(b), gelfLevel(b))
+	}
+	return u.Budget.Acquire(len(b))
+}
+
+// read will read the next packet, the peer credentials are
+// only read for unix sockets when the access list needs them
+func (u *Listener) read(b []byte) (int, net.Addr, *peerCredentials, error) {
+	if conn, ok := u.conn.(*net.UnixConn); ok && u.Options().AccessList.credentials() {
+		return readCredentials(conn, b)
 	}
+	n, address, err := u.conn.ReadFrom(b)
+	return n, address, nil, err
 }
-func (u *Listener) createId(in []byte, out []byte) {
-	hasher := sha1.New()
-	seed, _ := time.Now().MarshalBinary()
-	hasher.Write(seed)
-	hasher.Write(in)
-	copy(out, hasher.Sum(nil))
+
+// addressString returns the address of the sender, for unix sockets
+// the sender often has no address so the peer credentials are used
+func addressString(address net.Addr, peer *peerCredentials) string {
+	if peer != nil {
+		return fmt.Sprintf("pid=%d,uid=%d,gid=%d", peer.Pid, peer.Uid, peer.Gid)
+	}
+	if address == nil {
+		return ""
+	}
+	return address.String()
 }
 
-func (u *Listener) parse(buf []byte, id []byte) {
+func (u *Listener) parse(buf []byte, id []byte, source string) {
 	switch {
 	case buf[0] == 0x1e && buf[1] == 0x0f: // chunked
-		u.parseChunck(buf, id)
+		u.parseChunck(buf, id, source)
 	case buf[0] == 0x1f && buf[1] == 0x8b: // gzip
 		if ret, err := u.unmarshalGzip(buf); err != nil {
-			u.log.Debug(fmt.Sprintf("[%X] failed to decompress gzip stream", id))
-			u.Done <- err
+			u.log.Debug(logf(logFields{"id": hexId(id), "listener": u.String(), "error": err.Error()}, "[%X] failed to decompress gzip stream", id))
+			metricDecodeErrors.Inc(u.String(), "gzip")
+			u.send(err)
 		} else {
-			u.log.Debug(fmt.Sprintf("[%X] decompressed gzip srream", id))
-			u.Done <- append(id[:], ret...)
+			u.log.Debug(logf(logFields{"id": hexId(id), "listener": u.String(), "bytes": len(ret)}, "[%X] decompressed gzip srream", id))
+			u.emit(id, ret, source)
 		}
 	case buf[0] == 0x78 && buf[1] == 0xe5, // zlib
 		buf[0] == 0x78 && buf[1] == 0x9c,
 		buf[0] == 0x78 && buf[1] == 0xda:
 
 		if ret, err := u.unmarshalZlib(buf); err != nil {
-			u.log.Debug(fmt.Sprintf("[%X] failed to decompress zlib stream", id))
-			u.Done <- err
+			u.log.Debug(logf(logFields{"id": hexId(id), "listener": u.String(), "error": err.Error()}, "[%X] failed to decompress zlib stream", id))
+			metricDecodeErrors.Inc(u.String(), "zlib")
+			u.send(err)
 		} else {
-			u.log.Debug(fmt.Sprintf("[%X] decompressed zlib stream", id))
-			u.Done <- append(id[:], ret...)
+			u.log.Debug(logf(logFields{"id": hexId(id), "listener": u.String(), "bytes": len(ret)}, "[%X] decompressed zlib stream", id))
+			u.emit(id, ret, source)
 		}
 	default:
-		u.log.Debug(fmt.Sprintf("[%X] uncompressed stream", id))
-		u.Done <- append(id[:], buf...)
+		u.log.Debug(logf(logFields{"id": hexId(id), "listener": u.String(), "bytes": len(buf)}, "[%X] uncompressed stream", id))
+		u.emit(id, buf, source)
+	}
+}
+
+// emit will send the message on the Done channel when
+// it is not dropped by the rate limiter
+func (u *Listener) emit(id []byte, data []byte, source string) {
+	options := u.Options()
+	if options.RateLimiter != nil && !options.RateLimiter.Allow(data, source) {
+		metricRateLimited.Inc(u.String())
+		u.log.Debug(logf(logFields{"id": hexId(id), "listener": u.String(), "source": source, "bytes": len(data)}, "[%X] rate limited message of %d bytes from '%s'", id, len(data), source))
+		return
 	}
+	if options.InjectId {
+		data = injectField(data, MessageIdField, hexId(id))
+	}
+	u.send(append(id[:], data...))
 }
 
-func (u *Listener) parseChunck(b []byte, sid []byte) {
+func (u *Listener) parseChunck(b []byte, sid []byte, source string) {
+	if len(b) < 12 {
+		metricDecodeErrors.Inc(u.String(), "chunk")
+		u.send(fmt.Errorf("[%X] invalid chunk of %d bytes", sid, len(b)))
+		return
+	}
 	id, index, count := [8]byte{b[2], b[3], b[4], b[5], b[6], b[7], b[8], b[9]}, b[10], b[11]
-	u.log.Debug(fmt.Sprintf("[%X] chunck %X %d/%d", sid, id, index+1, count))
-	message, _ := u.queue.LoadOrStore(id, NewChunkMessage(make([][]byte, count, count), u, id, sid))
-	message.(*chunkMessage).chunks[index] = b[12:]
+	if count == 0 || count > maxChunks || index >= count {
+		metricDecodeErrors.Inc(u.String(), "chunk")
+		u.send(fmt.Errorf("[%X] invalid chunk sequence %d/%d", sid, index+1, count))
+		return
+	}
+	u.log.Debug(logf(logFields{"id": hexId(sid), "listener": u.String(), "chunked_id": hexId(id[:]), "chunk": int(index) + 1, "chunks": int(count)}, "[%X] chunck %X %d/%d", sid, id, index+1, count))
+	// the chunk is copied because the packet is released
+	// after it is parsed and the chunks can live longer
+	if !u.Budget.Acquire(len(b) - 12) {
+		u.log.Warning(logf(logFields{"id": hexId(sid), "listener": u.String(), "chunked_id": hexId(id[:]), "chunk": int(index) + 1, "chunks": int(count), "error": ErrBudgetExceeded.Error()}, "[%X] dropped chunk %d/%d of message %X, %s", sid, index+1, count, id, ErrBudgetExceeded.Error()))
+		return
+	}
+	chunk := make([]byte, len(b)-12)
+	copy(chunk, b[12:])
+	message, loaded := u.queue.Load(id)
+	if !loaded {
+		message, loaded = u.queue.LoadOrStore(id, newChunkMessage(count, u, id, sid, source))
+		if !loaded {
+			go message.(*chunkMessage).check()
+		}
+	}
+	message.(*chunkMessage).add(index, chunk)
 }
 
 func (u *Listener) unmarshalGzip(b []byte) ([]byte, error) {
@@ -154,7 +345,15 @@ func (u *Listener) connect() (err error) {
 	u.lock.Lock()
 	defer u.lock.Unlock()
 	if nil == u.conn {
-		u.conn, err = net.ListenPacket(u.network, u.address)
+		if u.conn, err = net.ListenPacket(u.network, u.address); err != nil {
+			return
+		}
+		if conn, ok := u.conn.(*net.UnixConn); ok && u.Options().AccessList.credentials() {
+			if err = enableCredentials(conn); err != nil {
+				return
+			}
+		}
+		atomic.StoreInt32(&u.bound, 1)
 	}
 	return
 }
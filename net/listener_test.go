@@ -0,0 +1,80 @@
+package net
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/pbergman/logger"
+)
+
+func TestListener_Close(t *testing.T) {
+	listener, err := NewListener("udp://127.0.0.1:0", logger.NewLogger("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := listener.Bind(); err != nil {
+		t.Fatal(err)
+	}
+	listener.SetOptions(&ListenerOptions{InjectId: true})
+	listener.parse([]byte(`{"version":"1.1"}`), []byte{0, 0, 0, 0, 0, 0, 0, 10}, "")
+	select {
+	case ret := <-listener.Done:
+		if out, ok := ret.([]byte); !ok || !bytes.Contains(out[8:], []byte(`"_proxy_msg_id":"000000000000000A"`)) {
+			t.Fatalf("expected the message id to be injected got %s", ret)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for message")
+	}
+	if err := listener.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if listener.State().Bound {
+		t.Fatal("expected a closed listener not to be bound")
+	}
+	// a packet that is still parsed after closing should be ignored
+	listener.parse([]byte(`{"version":"1.1"}`), make([]byte, 8), "")
+	if _, ok := <-listener.Done; ok {
+		t.Fatal("expected the Done channel to be closed")
+	}
+	listener.Close()
+}
+
+func TestListener_SetOptions(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on linux")
+	}
+	path := filepath.Join(t.TempDir(), "gelf.sock")
+	listener, err := NewListener("unixgram://"+path, logger.NewLogger("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if err := listener.Bind(); err != nil {
+		t.Fatal(err)
+	}
+	go listener.Listen()
+	// the credentials are enabled on the bound socket when the new access list needs them
+	list, err := NewAccessList(nil, nil, []uint32{uint32(os.Getuid())}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := listener.SetOptions(&ListenerOptions{AccessList: list}); err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.Dial("unixgram", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte(`{"version":"1.1"}`))
+	select {
+	case <-listener.Done:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the message to be allowed, %d rejected", list.Rejected())
+	}
+}
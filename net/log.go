@@ -0,0 +1,22 @@
+package net
+
+import (
+	"fmt"
+
+	"github.com/pbergman/logger"
+)
+
+// logFields holds the structured context of a log message, the text
+// output only shows the message and the json output (see log-format)
+// writes every field as a separate key.
+type logFields map[string]interface{}
+
+// logf returns a log message with the formatted text and the fields as context
+func logf(fields logFields, format string, args ...interface{}) logger.LogMessageInterface {
+	return logger.Message(fmt.Sprintf(format, args...), fields)
+}
+
+// hexId returns the message id as it is shown in the logs
+func hexId(id []byte) string {
+	return fmt.Sprintf("%X", id)
+}
@@ -0,0 +1,181 @@
+package net
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"os"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pbergman/logger"
+)
+
+// idPattern matches the message id the pools and listener
+// prefix their log messages with, like [ACBBF4A0AD1EEA73]
+var idPattern = regexp.MustCompile(`^\[([0-9A-F]{16,40})\]`)
+
+// GelfLogHandler is a logger handler that sends the log records as GELF
+// messages through a pool, so the logs of the proxy end up in Graylog.
+//
+// The records are handled by a single goroutine so logging never
+// blocks on the pool and logging by the pool (while pushing a record)
+// can not recurse. To prevent a feedback loop the records about the
+// messages that are created by this handler (like a failed delivery)
+// and about the other internal messages (like a heartbeat) are not
+// forwarded, the records about the received messages (like a retry or
+// a full queue) are forwarded. The records are pushed as internal
+// messages so they never take the place of a
+// received message, and are limited to logForwardRate records per
+// second, when the buffer is full or the limit is exceeded records
+// are dropped.
+type GelfLogHandler struct {
+	level    uint32
+	target   atomic.Value
+	hostname string
+	records  chan *logger.Record
+	own      map[string]struct{}
+	ring     []string
+	next     int
+	lock     sync.Mutex
+	once     sync.Once
+	dropped  uint64
+	limit    tokenBucket
+}
+
+const (
+	// logForwardRate is the amount of records per second that are
+	// forwarded and logForwardBurst the max amount above that rate
+	logForwardRate  = 10
+	logForwardBurst = 100
+)
+
+// gelfTarget is the pool the records are sent through with
+// the delimiter that is added to every message
+type gelfTarget struct {
+	pool      ConnPoolInterface
+	delimiter byte
+}
+
+func (g *GelfLogHandler) pool() *gelfTarget {
+	target, _ := g.target.Load().(*gelfTarget)
+	return target
+}
+
+// gelfLogLevel converts the level of a record to the syslog level
+func gelfLogLevel(level logger.LogLevel) int {
+	return bits.TrailingZeros8(uint8(level))
+}
+
+func (g *GelfLogHandler) IsHandling(r *logger.Record) bool {
+	return g.pool() != nil && r.Level.Match(logger.LogLevel(atomic.LoadUint32(&g.level)))
+}
+
+func (g *GelfLogHandler) Handle(r *logger.Record) bool {
+	if !g.IsHandling(r) {
+		return false
+	}
+	select {
+	case g.records <- r:
+	default:
+		atomic.AddUint64(&g.dropped, 1)
+	}
+	return false
+}
+
+// Forward will start sending the records with the given level through the
+// pool, the delimiter is added to every message (a null byte or new line).
+// It can be called again to change the pool or level, a level of 0 will
+// stop forwarding the records.
+func (g *GelfLogHandler) Forward(pool ConnPoolInterface, level logger.LogLevel, delimiter byte) {
+	atomic.StoreUint32(&g.level, uint32(level))
+	g.target.Store(&gelfTarget{pool: pool, delimiter: delimiter})
+	g.once.Do(func() { go g.run() })
+}
+
+// Dropped returns the amount of records that were not forwarded because
+// the pool could not keep up with the records or the rate was exceeded
+func (g *GelfLogHandler) Dropped() uint64 {
+	return atomic.LoadUint64(&g.dropped)
+}
+
+// remember will store the id of a message created by this handler, only
+// the last ids are kept because records about older messages are unlikely
+func (g *GelfLogHandler) remember(id string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if old := g.ring[g.next]; old != "" {
+		delete(g.own, old)
+	}
+	g.ring[g.next], g.own[id] = id, struct{}{}
+	g.next = (g.next + 1) % len(g.ring)
+}
+
+func (g *GelfLogHandler) isOwn(id string) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	_, ok := g.own[id]
+	return ok
+}
+
+func (g *GelfLogHandler) message(r *logger.Record, related string, delimiter byte) []byte {
+	fields := map[string]interface{}{
+		"version":       "1.1",
+		"host":          g.hostname,
+		"short_message": r.Message,
+		"timestamp":     float64(r.Time.UnixNano()) / 1e9,
+		"level":         gelfLogLevel(r.Level),
+		"_component":    "graylog-proxy",
+		"_logger":       r.Name,
+	}
+	if related != "" {
+		fields[MessageIdField] = related
+	}
+	// the id is set as _proxy_msg_id because _id is reserved by GELF
+	for key, value := range r.Context {
+		if _, ok := fields["_"+key]; !ok && key != "id" {
+			fields["_"+key] = value
+		}
+	}
+	message, _ := json.Marshal(fields)
+	return append(message, delimiter)
+}
+
+func (g *GelfLogHandler) run() {
+	for record := range g.records {
+		related, _ := record.Context["id"].(string)
+		if match := idPattern.FindStringSubmatch(record.Message); match != nil && related == "" {
+			related = match[1]
+		}
+		if related != "" && g.isOwn(related) {
+			continue
+		}
+		if internal, _ := record.Context["internal"].(bool); internal {
+			continue
+		}
+		if !g.limit.take(1, time.Now()) {
+			atomic.AddUint64(&g.dropped, 1)
+			continue
+		}
+		id := make([]byte, 8)
+		rand.Read(id)
+		g.remember(fmt.Sprintf("%X", id))
+		target := g.pool()
+		target.pool.PushInternal(g.message(record, related, target.delimiter), id)
+	}
+}
+
+// NewGelfLogHandler creates a handler that does nothing till Forward is called
+func NewGelfLogHandler() *GelfLogHandler {
+	hostname, _ := os.Hostname()
+	return &GelfLogHandler{
+		hostname: hostname,
+		records:  make(chan *logger.Record, 256),
+		own:      make(map[string]struct{}),
+		ring:     make([]string, 1024),
+		limit:    tokenBucket{rate: logForwardRate, burst: logForwardBurst, tokens: logForwardBurst, last: time.Now()},
+	}
+}
@@ -0,0 +1,114 @@
+package net
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pbergman/logger"
+)
+
+type testPool struct {
+	connQueue
+}
+
+func (p *testPool) Close()      { p.close() }
+func (p *testPool) Start(n int) {}
+
+func TestGelfLogHandler(t *testing.T) {
+	pool := &testPool{connQueue{tries: 1, queue: newPriorityQueue(10), logger: logger.NewLogger("test")}}
+	handler := NewGelfLogHandler()
+	log := logger.NewLogger("test", handler)
+	log.Error("not forwarded")
+	handler.Forward(pool, logger.LogLevelWarning(), 0)
+	log.Notice("not forwarded")
+	log.Error("[00000000000000AA] failed")
+	item, _ := pool.queue.pop(time.After(time.Second))
+	if item == nil {
+		t.Fatal("expected the error to be forwarded")
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(item.data[:len(item.data)-1], &fields); err != nil {
+		t.Fatal(err)
+	}
+	if fields["level"] != float64(3) || fields["_component"] != "graylog-proxy" || fields[MessageIdField] != "00000000000000AA" {
+		t.Fatalf("unexpected message %s", item.data)
+	}
+	// a record about a forwarded record should not be forwarded
+	log.Error(fmt.Sprintf("[%X] failed", item.id))
+	if item, _ := pool.queue.pop(time.After(100 * time.Millisecond)); item != nil {
+		t.Fatalf("expected no feedback message got %s", item.data)
+	}
+}
+
+// waitDiscarded will wait till the pool discarded the given amount of messages
+func waitDiscarded(t *testing.T, pool *testPool, discarded uint64) {
+	for i := 0; pool.State().Discarded < discarded; i++ {
+		if i == 100 {
+			t.Fatalf("expected %d discarded messages got %d", discarded, pool.State().Discarded)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGelfLogHandler_fullQueue(t *testing.T) {
+	handler := NewGelfLogHandler()
+	log := logger.NewLogger("test", handler)
+	pool := &testPool{connQueue{name: "tcp://127.0.0.1:12201", tries: 1, queue: newPriorityQueue(2), logger: log}}
+	handler.Forward(pool, logger.LogLevelDebug(), 0)
+	log.Error("first")
+	for i := 0; pool.queue.Len() == 0; i++ {
+		if i == 100 {
+			t.Fatal("expected the record to be forwarded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	first, second := pool.Push([]byte(`{"level":6}`), nil), pool.Push([]byte(`{"level":6}`), nil)
+	// the forwarded record is dropped to make room for the received message
+	waitDiscarded(t, pool, 1)
+	if first.HasError() || second.HasError() {
+		t.Fatal("expected the received messages to be queued")
+	}
+	// a forwarded record never takes the place of a received message
+	log.Error("second")
+	waitDiscarded(t, pool, 2)
+	if counts := pool.queue.counts(); counts[6] != 2 {
+		t.Fatalf("expected the received messages to be queued got %v", counts)
+	}
+	// the warning about the dropped message is forwarded (and dropped because
+	// the queue is full) but the log about that forwarded record is not
+	if third := pool.Push([]byte(`{"level":7}`), nil); !third.Shed() {
+		t.Fatal("expected the message to be dropped")
+	}
+	waitDiscarded(t, pool, 4)
+	time.Sleep(100 * time.Millisecond)
+	if discarded := pool.State().Discarded; discarded != 4 {
+		t.Fatalf("expected no feedback message got %d discarded messages", discarded)
+	}
+	// the logs about internal messages (like a heartbeat) are not forwarded
+	pool.PushInternal([]byte(`{"level":6}`), nil)
+	time.Sleep(100 * time.Millisecond)
+	if discarded := pool.State().Discarded; discarded != 5 {
+		t.Fatalf("expected no feedback message got %d discarded messages", discarded)
+	}
+}
+
+func TestGelfLogHandler_limit(t *testing.T) {
+	pool := &testPool{connQueue{tries: 1, queue: newPriorityQueue(1000), logger: logger.NewLogger("test")}}
+	handler := NewGelfLogHandler()
+	log := logger.NewLogger("test", handler)
+	handler.Forward(pool, logger.LogLevelError(), 0)
+	for i := 0; i < logForwardBurst*2; i++ {
+		log.Error(fmt.Sprintf("record %d", i))
+	}
+	for i := 0; pool.queue.Len()+int(handler.Dropped()) < logForwardBurst*2; i++ {
+		if i == 100 {
+			t.Fatal("expected all records to be handled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if queued := pool.queue.Len(); queued < logForwardBurst || queued > logForwardBurst+logForwardRate {
+		t.Fatalf("expected about %d forwarded records got %d", logForwardBurst, queued)
+	}
+}
@@ -1,51 +1,84 @@
 package net
 
 import (
-	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type chunkMessage struct {
 	end      time.Time
-	ticker   *time.Ticker
 	chunks   [][]byte
+	size     int
+	lock     sync.Mutex
 	listener *Listener
 	id       [8]byte
 	sid      []byte
+	source   string
 	callback func([]byte, error)
 }
 
-func (c *chunkMessage) Close() {
-	c.ticker.Stop()
+// add will set the chunk for the given index, the memory
+// of the chunk is released when the message is completed
+// or expired
+func (c *chunkMessage) add(index byte, chunk []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if int(index) >= len(c.chunks) {
+		c.listener.Budget.Release(len(chunk))
+		return
+	}
+	c.size += len(chunk) - len(c.chunks[index])
+	c.listener.Budget.Release(len(c.chunks[index]))
+	c.chunks[index] = chunk
 }
 
 func (c *chunkMessage) check() {
-	defer c.ticker.Stop()
-	for now := range c.ticker.C {
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	defer c.release()
+	for now := range ticker.C {
 		if c.valid() {
-			c.listener.log.Debug(fmt.Sprintf("[%X] message %X complete", c.sid, c.id[:]))
-			c.listener.parse(c.merge(), c.sid)
+			c.listener.log.Debug(logf(logFields{"id": hexId(c.sid), "listener": c.listener.String(), "chunked_id": hexId(c.id[:])}, "[%X] message %X complete", c.sid, c.id[:]))
+			metricChunks.Inc(c.listener.String(), "completed")
 			c.listener.queue.Delete(c.id)
+			c.listener.parse(c.merge(), c.sid, c.source)
 			return
 		}
 		// expires, all message should arrive within 5 seconds
 		// http://docs.graylog.org/en/2.3/pages/gelf.html#chunking
 		if c.end.Before(now) {
-			c.listener.log.Debug(fmt.Sprintf("[%X] timeout, discarding message %X", c.sid, c.id[:]))
+			c.listener.log.Debug(logf(logFields{"id": hexId(c.sid), "listener": c.listener.String(), "chunked_id": hexId(c.id[:])}, "[%X] timeout, discarding message %X", c.sid, c.id[:]))
+			metricChunks.Inc(c.listener.String(), "expired")
+			atomic.AddUint64(&c.listener.dropped, 1)
+			c.listener.queue.Delete(c.id)
 			return
 		}
 	}
 }
 
-func (c chunkMessage) merge() []byte {
-	var buf []byte
+// release will free the memory of the chunks, chunks that
+// are added after this will be released immediately
+func (c *chunkMessage) release() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.listener.Budget.Release(c.size)
+	c.chunks, c.size = nil, 0
+}
+
+func (c *chunkMessage) merge() []byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	buf := make([]byte, 0, c.size)
 	for i := 0; i < len(c.chunks); i++ {
 		buf = append(buf, c.chunks[i]...)
 	}
 	return buf
 }
 
-func (c chunkMessage) valid() bool {
+func (c *chunkMessage) valid() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	for i := 0; i < len(c.chunks); i++ {
 		if len(c.chunks[i]) <= 0 {
 			return false
@@ -54,15 +87,13 @@ func (c chunkMessage) valid() bool {
 	return true
 }
 
-func NewChunkMessage(ref [][]byte, listener *Listener, id [8]byte, sid []byte) *chunkMessage {
-	message := &chunkMessage{
-		chunks:   ref,
+func newChunkMessage(count byte, listener *Listener, id [8]byte, sid []byte, source string) *chunkMessage {
+	return &chunkMessage{
+		chunks:   make([][]byte, count),
 		sid:      sid,
+		source:   source,
 		end:      time.Now().Add(5 * time.Second),
-		ticker:   time.NewTicker(250 * time.Millisecond),
 		listener: listener,
 		id:       id,
 	}
-	go message.check()
-	return message
 }
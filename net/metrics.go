@@ -0,0 +1,225 @@
+package net
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metricFamily holds all the values of a metric, one value
+// for every combination of label values.
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	lock    sync.Mutex
+	values  map[string]*metricValue
+}
+
+type metricValue struct {
+	labels  []string
+	counter uint64
+	gauge   func() float64
+	// owner is the value that set the gauge (see SetFor)
+	owner interface{}
+	// the histogram counts are guarded by the family lock
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (m *metricFamily) get(labels []string) *metricValue {
+	if len(labels) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s expects %d labels got %d", m.name, len(m.labels), len(labels)))
+	}
+	key := strings.Join(labels, "\xff")
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	value, ok := m.values[key]
+	if !ok {
+		value = &metricValue{labels: labels}
+		if m.kind == "histogram" {
+			value.counts = make([]uint64, len(m.buckets))
+		}
+		m.values[key] = value
+	}
+	return value
+}
+
+// Inc will increase the counter for the given label values
+func (m *metricFamily) Inc(labels ...string) {
+	m.Add(1, labels...)
+}
+
+// Add will increase the counter for the given label values with delta
+func (m *metricFamily) Add(delta uint64, labels ...string) {
+	atomic.AddUint64(&m.get(labels).counter, delta)
+}
+
+// Set will set the callback that returns the value of a gauge
+func (m *metricFamily) Set(gauge func() float64, labels ...string) {
+	m.SetFor(nil, gauge, labels...)
+}
+
+// SetFor will set the callback of a gauge for the given owner, see RemoveFor
+func (m *metricFamily) SetFor(owner interface{}, gauge func() float64, labels ...string) {
+	value := m.get(labels)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	value.gauge, value.owner = gauge, owner
+}
+
+// Remove will remove the value for the given label values, this is used
+// for gauges of pools and listeners that are closed
+func (m *metricFamily) Remove(labels ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.values, strings.Join(labels, "\xff"))
+}
+
+// RemoveFor will remove the value for the given label values when the
+// gauge is still set by the owner, so a pool that is closed after it was
+// replaced by a pool for the same remote keeps the gauge of the new pool
+func (m *metricFamily) RemoveFor(owner interface{}, labels ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	key := strings.Join(labels, "\xff")
+	if value, ok := m.values[key]; ok && value.owner == owner {
+		delete(m.values, key)
+	}
+}
+
+// Observe will add the value to the histogram for the given label values
+func (m *metricFamily) Observe(v float64, labels ...string) {
+	value := m.get(labels)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for i, bucket := range m.buckets {
+		if v <= bucket {
+			value.counts[i]++
+		}
+	}
+	value.sum += v
+	value.count++
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func (m *metricFamily) format(labels []string, extra ...string) string {
+	var pairs []string
+	for i, name := range m.labels {
+		pairs = append(pairs, name+`="`+escapeLabel(labels[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (m *metricFamily) write(w io.Writer) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(m.values) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	for _, key := range keys {
+		value := m.values[key]
+		switch m.kind {
+		case "counter":
+			fmt.Fprintf(&buf, "%s%s %d\n", m.name, m.format(value.labels), atomic.LoadUint64(&value.counter))
+		case "gauge":
+			if value.gauge != nil {
+				fmt.Fprintf(&buf, "%s%s %s\n", m.name, m.format(value.labels), formatFloat(value.gauge()))
+			}
+		case "histogram":
+			for i, bucket := range m.buckets {
+				fmt.Fprintf(&buf, "%s_bucket%s %d\n", m.name, m.format(value.labels, "le", formatFloat(bucket)), value.counts[i])
+			}
+			fmt.Fprintf(&buf, "%s_bucket%s %d\n", m.name, m.format(value.labels, "le", "+Inf"), value.count)
+			fmt.Fprintf(&buf, "%s_sum%s %s\n", m.name, m.format(value.labels), formatFloat(value.sum))
+			fmt.Fprintf(&buf, "%s_count%s %d\n", m.name, m.format(value.labels), value.count)
+		}
+	}
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
+
+type metricRegistry struct {
+	families []*metricFamily
+}
+
+func (r *metricRegistry) register(name, help, kind string, buckets []float64, labels ...string) *metricFamily {
+	family := &metricFamily{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		values:  make(map[string]*metricValue),
+	}
+	r.families = append(r.families, family)
+	return family
+}
+
+var (
+	metrics = new(metricRegistry)
+
+	metricPacketsReceived = metrics.register("graylog_proxy_packets_received_total", "The amount of received packets.", "counter", nil, "listener")
+	metricBytesReceived   = metrics.register("graylog_proxy_received_bytes_total", "The amount of received bytes.", "counter", nil, "listener")
+	metricPacketsRejected = metrics.register("graylog_proxy_packets_rejected_total", "The amount of packets rejected by the access list.", "counter", nil, "listener")
+	metricDecodeErrors    = metrics.register("graylog_proxy_decode_errors_total", "The amount of packets that could not be decoded by type.", "counter", nil, "listener", "type")
+	metricChunks          = metrics.register("graylog_proxy_chunked_messages_total", "The amount of chunked messages by result (completed or expired).", "counter", nil, "listener", "result")
+	metricRateLimited     = metrics.register("graylog_proxy_rate_limited_total", "The amount of messages dropped by the rate limiter.", "counter", nil, "listener")
+	metricQueueDepth      = metrics.register("graylog_proxy_queue_depth", "The amount of messages in the queue of a remote.", "gauge", nil, "remote")
+	metricDeliveries      = metrics.register("graylog_proxy_deliveries_total", "The amount of messages delivered to a remote.", "counter", nil, "remote")
+	metricRetries         = metrics.register("graylog_proxy_retries_total", "The amount of failed deliveries that are retried.", "counter", nil, "remote")
+	metricDiscards        = metrics.register("graylog_proxy_discards_total", "The amount of messages that are discarded by reason.", "counter", nil, "remote", "reason")
+	metricDials           = metrics.register("graylog_proxy_dials_total", "The amount of connections that are made to a remote.", "counter", nil, "remote")
+	metricDialErrors      = metrics.register("graylog_proxy_dial_errors_total", "The amount of connections to a remote that failed.", "counter", nil, "remote")
+	metricTlsFailures     = metrics.register("graylog_proxy_tls_handshake_failures_total", "The amount of failed tls handshakes with a remote.", "counter", nil, "remote")
+	metricLatency         = metrics.register("graylog_proxy_delivery_latency_seconds", "The time between queueing a received message and the delivery to a remote.", "histogram", []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}, "remote")
+	metricMemoryUsed      = metrics.register("graylog_proxy_memory_used_bytes", "The amount of bytes reserved from the memory budget.", "gauge", nil)
+	metricMemoryLimit     = metrics.register("graylog_proxy_memory_limit_bytes", "The limit of the memory budget.", "gauge", nil)
+)
+
+// observeLatency will add the time since the given time to the latency histogram
+func observeLatency(remote string, since time.Time) {
+	metricLatency.Observe(time.Since(since).Seconds(), remote)
+}
+
+// WriteMetrics will write all metrics in the prometheus text format
+func WriteMetrics(w io.Writer) error {
+	for _, family := range metrics.families {
+		if err := family.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
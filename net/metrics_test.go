@@ -0,0 +1,54 @@
+package net
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMetricFamily_write(t *testing.T) {
+	registry := new(metricRegistry)
+	counter := registry.register("test_total", "A test counter.", "counter", nil, "remote")
+	counter.Inc("a")
+	counter.Add(2, `b"c`)
+	histogram := registry.register("test_seconds", "A test histogram.", "histogram", []float64{.1, 1}, "remote")
+	histogram.Observe(.5, "a")
+	histogram.Observe(2, "a")
+	var buf bytes.Buffer
+	for _, family := range registry.families {
+		if err := family.write(&buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := `# HELP test_total A test counter.
+# TYPE test_total counter
+test_total{remote="a"} 1
+test_total{remote="b\"c"} 2
+# HELP test_seconds A test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{remote="a",le="0.1"} 0
+test_seconds_bucket{remote="a",le="1"} 1
+test_seconds_bucket{remote="a",le="+Inf"} 2
+test_seconds_sum{remote="a"} 2.5
+test_seconds_count{remote="a"} 2
+`
+	if buf.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestMetricFamily_RemoveFor(t *testing.T) {
+	registry := new(metricRegistry)
+	gauge := registry.register("test_depth", "A test gauge.", "gauge", nil, "remote")
+	old, replaced := new(int), new(int)
+	gauge.SetFor(old, func() float64 { return 1 }, "a")
+	gauge.SetFor(replaced, func() float64 { return 2 }, "a")
+	gauge.RemoveFor(old, "a")
+	var buf bytes.Buffer
+	if gauge.write(&buf); !bytes.Contains(buf.Bytes(), []byte(`test_depth{remote="a"} 2`)) {
+		t.Fatalf("expected the gauge of the new owner to be kept, got:\n%s", buf.String())
+	}
+	gauge.RemoveFor(replaced, "a")
+	if buf.Reset(); gauge.write(&buf) != nil || buf.Len() != 0 {
+		t.Fatalf("expected the gauge to be removed, got:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,45 @@
+//go:build linux
+
+package net
+
+import (
+	"net"
+	"syscall"
+)
+
+// enableCredentials will enable SO_PASSCRED on the socket so the
+// kernel adds the credentials of the sender to every message
+func enableCredentials(conn *net.UnixConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var opt error
+	if err := raw.Control(func(fd uintptr) {
+		opt = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_PASSCRED, 1)
+	}); err != nil {
+		return err
+	}
+	return opt
+}
+
+// readCredentials will read a message with the credentials of the sender
+func readCredentials(conn *net.UnixConn, b []byte) (int, net.Addr, *peerCredentials, error) {
+	oob := make([]byte, syscall.CmsgSpace(syscall.SizeofUcred))
+	n, oobn, _, address, err := conn.ReadMsgUnix(b, oob)
+	if err != nil {
+		return n, nil, nil, err
+	}
+	var peer *peerCredentials
+	if messages, err := syscall.ParseSocketControlMessage(oob[:oobn]); err == nil {
+		for _, message := range messages {
+			if credentials, err := syscall.ParseUnixCredentials(&message); err == nil {
+				peer = &peerCredentials{Pid: credentials.Pid, Uid: credentials.Uid, Gid: credentials.Gid}
+			}
+		}
+	}
+	if address == nil {
+		return n, nil, peer, nil
+	}
+	return n, address, peer, nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package net
+
+import (
+	"errors"
+	"net"
+)
+
+func enableCredentials(conn *net.UnixConn) error {
+	return errors.New("peer credentials are only supported on linux")
+}
+
+func readCredentials(conn *net.UnixConn, b []byte) (int, net.Addr, *peerCredentials, error) {
+	n, address, err := conn.ReadFrom(b)
+	return n, address, nil, err
+}
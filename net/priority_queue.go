@@ -0,0 +1,236 @@
+package net
+
+import (
+	"sync"
+	"time"
+)
+
+// priorityQueue is a queue that will return the most severe messages
+// first (and in order of arrival for messages with the same level).
+//
+// When the queue is full a less severe queued message is replaced by a
+// new more severe message, so the low severity messages are shed first.
+// Messages with a level of critical or more severe are never dropped,
+// pushing those will block till there is room in the queue. Internal
+// messages (created by the proxy itself) are queued as the least severe
+// level and are dropped when the queue is full, so they never take the
+// place of a received message.
+type priorityQueue struct {
+	lock   sync.Mutex
+	levels [8][]*ConnQueueItem
+	size   int
+	max    int
+	closed bool
+	// paused will hold back the items till resumed, on
+	// close the items are returned so they are drained
+	paused bool
+	// flushed is closed (and replaced) on a flush so the
+	// goroutines waiting for more items stop waiting
+	flushed chan struct{}
+	// ready and space are signalled when an item
+	// is added or removed, the waiting goroutine
+	// will pass the signal on when there is more
+	ready chan struct{}
+	space chan struct{}
+}
+
+// expired can be used with pop for not waiting on new items
+var expired = func() <-chan time.Time {
+	c := make(chan time.Time)
+	close(c)
+	return c
+}()
+
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+func queueLevel(item *ConnQueueItem) int {
+	switch {
+	case item.internal:
+		return LevelDebug
+	case item.level < 0:
+		return 0
+	case item.level > 7:
+		return 7
+	default:
+		return item.level
+	}
+}
+
+func (q *priorityQueue) add(item *ConnQueueItem) {
+	level := queueLevel(item)
+	q.levels[level] = append(q.levels[level], item)
+	q.size++
+	notify(q.ready)
+}
+
+// evict will remove the newest item of the least severe level when
+// that level is less severe than the given level and the level is
+// not critical or more severe.
+func (q *priorityQueue) evict(level int) *ConnQueueItem {
+	for i := len(q.levels) - 1; i > level && i > LevelCritical; i-- {
+		if size := len(q.levels[i]); size > 0 {
+			item := q.levels[i][size-1]
+			q.levels[i][size-1] = nil
+			q.levels[i] = q.levels[i][:size-1]
+			q.size--
+			return item
+		}
+	}
+	return nil
+}
+
+// push will add the item to the queue, when the queue is full the
+// item that was dropped is returned which can be a queued item or
+// the given item. When the queue is closed the item is returned.
+func (q *priorityQueue) push(item *ConnQueueItem) *ConnQueueItem {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for q.size >= q.max && !q.closed {
+		if dropped := q.evict(queueLevel(item)); dropped != nil {
+			q.add(item)
+			return dropped
+		}
+		if item.internal || item.level > LevelCritical {
+			return item
+		}
+		q.lock.Unlock()
+		<-q.space
+		q.lock.Lock()
+	}
+	if q.closed {
+		return item
+	}
+	q.add(item)
+	if q.size < q.max {
+		notify(q.space)
+	}
+	return nil
+}
+
+// requeue will add the item without checking the size of the queue, this
+// is used for retries so a worker will never block on a full queue.
+func (q *priorityQueue) requeue(item *ConnQueueItem) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return false
+	}
+	q.add(item)
+	return true
+}
+
+func (q *priorityQueue) next() *ConnQueueItem {
+	if q.paused && !q.closed {
+		return nil
+	}
+	for i := range q.levels {
+		if len(q.levels[i]) > 0 {
+			item := q.levels[i][0]
+			q.levels[i][0] = nil
+			q.levels[i] = q.levels[i][1:]
+			q.size--
+			return item
+		}
+	}
+	return nil
+}
+
+// pop will return the most severe item, it will wait for a new item till
+// the given channel receives a value or is closed (a nil channel will wait
+// till there is an item). It will return false when the queue is closed
+// and empty.
+func (q *priorityQueue) pop(wait <-chan time.Time) (*ConnQueueItem, bool) {
+	for {
+		q.lock.Lock()
+		item := q.next()
+		closed, flushed := q.closed, q.flushed
+		if item != nil && !closed {
+			if q.size > 0 {
+				notify(q.ready)
+			}
+			notify(q.space)
+		}
+		q.lock.Unlock()
+		if item != nil {
+			return item, true
+		}
+		if closed {
+			return nil, false
+		}
+		select {
+		case <-q.ready:
+		case <-wait:
+			return nil, true
+		case <-flushed:
+			if wait != nil {
+				return nil, true
+			}
+		}
+	}
+}
+
+// pause will hold back the queued items till resumed
+func (q *priorityQueue) pause(paused bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.paused = paused
+	if !paused && q.size > 0 {
+		notify(q.ready)
+	}
+}
+
+// flush will stop the goroutines that are waiting for more items
+// in pop (with a wait channel) so collected items are written now
+func (q *priorityQueue) flush() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	close(q.flushed)
+	q.flushed = make(chan struct{})
+}
+
+// counts returns the amount of queued items per level
+func (q *priorityQueue) counts() []int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	counts := make([]int, len(q.levels))
+	for i := range q.levels {
+		counts[i] = len(q.levels[i])
+	}
+	return counts
+}
+
+// Len returns the amount of queued items
+func (q *priorityQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.size
+}
+
+// close will stop accepting new items, the queued items
+// can be still be read till the queue is empty.
+func (q *priorityQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.ready)
+		close(q.space)
+	}
+}
+
+func newPriorityQueue(max int) *priorityQueue {
+	if max <= 0 {
+		max = 1
+	}
+	return &priorityQueue{
+		max:     max,
+		ready:   make(chan struct{}, 1),
+		space:   make(chan struct{}, 1),
+		flushed: make(chan struct{}),
+	}
+}
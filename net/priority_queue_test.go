@@ -0,0 +1,114 @@
+package net
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPriorityQueue(t *testing.T) {
+	queue := newPriorityQueue(3)
+	for _, level := range []int{7, 6, 7} {
+		if dropped := queue.push(&ConnQueueItem{level: level}); dropped != nil {
+			t.Fatalf("expected item with level %d to be queued", level)
+		}
+	}
+	if dropped := queue.push(&ConnQueueItem{level: 7}); dropped == nil || dropped.level != 7 || queue.Len() != 3 {
+		t.Fatal("expected the new debug item to be dropped")
+	}
+	if dropped := queue.push(&ConnQueueItem{level: 3}); dropped == nil || dropped.level != 7 {
+		t.Fatal("expected a queued debug item to be dropped for an error item")
+	}
+	if dropped := queue.push(&ConnQueueItem{level: 1}); dropped == nil || dropped.level != 7 {
+		t.Fatal("expected a queued debug item to be dropped for an alert item")
+	}
+	for _, level := range []int{1, 3, 6} {
+		if item, _ := queue.pop(expired); item == nil || item.level != level {
+			t.Fatalf("expected item with level %d", level)
+		}
+	}
+	if item, ok := queue.pop(expired); item != nil || !ok {
+		t.Fatal("expected no item from an empty queue")
+	}
+	for i := 0; i < 3; i++ {
+		queue.push(&ConnQueueItem{level: 0})
+	}
+	pushed := make(chan struct{})
+	go func() {
+		queue.push(&ConnQueueItem{level: 2})
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("expected push of a critical item to wait on a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	queue.pop(nil)
+	select {
+	case <-pushed:
+	case <-time.After(time.Second):
+		t.Fatal("expected push of a critical item to continue when there is room")
+	}
+	queue.close()
+	for i := 0; i < 3; i++ {
+		if _, ok := queue.pop(nil); !ok {
+			t.Fatal("expected queued items to be returned after close")
+		}
+	}
+	if _, ok := queue.pop(nil); ok {
+		t.Fatal("expected a closed and empty queue to return false")
+	}
+}
+
+func TestPriorityQueue_pause(t *testing.T) {
+	queue := newPriorityQueue(3)
+	queue.pause(true)
+	queue.push(&ConnQueueItem{level: 6})
+	if item, ok := queue.pop(expired); item != nil || !ok {
+		t.Fatal("expected no item from a paused queue")
+	}
+	popped := make(chan *ConnQueueItem)
+	go func() {
+		item, _ := queue.pop(nil)
+		popped <- item
+	}()
+	queue.pause(false)
+	select {
+	case item := <-popped:
+		if item == nil || item.level != 6 {
+			t.Fatal("expected the queued item after resume")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected pop to continue when resumed")
+	}
+	go func() {
+		item, _ := queue.pop(time.After(time.Minute))
+		popped <- item
+	}()
+	time.Sleep(10 * time.Millisecond)
+	queue.flush()
+	select {
+	case item := <-popped:
+		if item != nil {
+			t.Fatal("expected no item on flush")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected pop to stop waiting on flush")
+	}
+}
+
+func TestPriorityQueue_malformed(t *testing.T) {
+	queue := newPriorityQueue(1)
+	queue.push(&ConnQueueItem{level: 0})
+	pushed := make(chan *ConnQueueItem)
+	go func() {
+		pushed <- queue.push(new(connQueue).newQueueItem([]byte(`{"short_message":`), nil))
+	}()
+	select {
+	case dropped := <-pushed:
+		if dropped == nil || dropped.level != LevelDebug {
+			t.Fatal("expected the message that can not be parsed to be dropped")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected push of a message that can not be parsed not to wait on a full queue")
+	}
+}
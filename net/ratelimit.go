@@ -0,0 +1,229 @@
+package net
+
+import (
+	"container/list"
+	"encoding/json"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// tokenBucket holds tokens that are refilled with the rate per second
+// till the burst size, a zero rate means there is no limit.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (t *tokenBucket) take(n float64, now time.Time) bool {
+	if t.rate <= 0 {
+		return true
+	}
+	t.tokens += now.Sub(t.last).Seconds() * t.rate
+	t.last = now
+	if t.tokens > t.burst {
+		t.tokens = t.burst
+	}
+	if t.tokens < n {
+		return false
+	}
+	t.tokens -= n
+	return true
+}
+
+func (t *tokenBucket) give(n float64) {
+	t.tokens += n
+}
+
+func (t *tokenBucket) full(now time.Time) bool {
+	return t.rate <= 0 || t.tokens+now.Sub(t.last).Seconds()*t.rate >= t.burst
+}
+
+// RateLimitOptions holds the settings for the rate limiter
+type RateLimitOptions struct {
+	// Key is what the limits are applied on, this can be "source"
+	// for the address the message was received from or the name
+	// of a GELF field like "host" or "_app"
+	Key string
+	// Messages is the allowed amount of messages per second
+	// and MessageBurst the max amount above that rate
+	Messages     float64
+	MessageBurst int
+	// Bytes is the allowed amount of bytes per second and
+	// ByteBurst the max amount of bytes above that rate
+	Bytes     float64
+	ByteBurst int
+	// MaxKeys is the max amount of keys that are tracked (default
+	// 10000), when reached the least recently used key is removed
+	MaxKeys int
+}
+
+// RateLimitSummary holds the amount of messages that were dropped for a key
+type RateLimitSummary struct {
+	Key      string
+	Messages uint64
+	Bytes    uint64
+}
+
+type rateLimitEntry struct {
+	messages tokenBucket
+	bytes    tokenBucket
+	dropped  RateLimitSummary
+}
+
+// RateLimiter applies token bucket limits on the received messages
+// for every source address or value of the configured GELF field.
+//
+// The keys can be chosen by the sender (like a spoofed udp source) so
+// the idle keys are removed every prune interval and the amount of keys
+// is capped, the entries are kept in order of use for that.
+type RateLimiter struct {
+	options *RateLimitOptions
+	entries map[string]*list.Element
+	order   *list.List
+	pruned  time.Time
+	total   RateLimitSummary
+	lock    sync.Mutex
+}
+
+// rateLimitPruneInterval is the interval for removing the idle keys
+const rateLimitPruneInterval = time.Second
+
+// key returns the key for the message, for the source address the
+// port is removed because that will change for every (new) socket.
+func (r *RateLimiter) key(data []byte, source string) string {
+	if r.options.Key == "source" {
+		if host, _, err := net.SplitHostPort(source); err == nil {
+			return host
+		}
+		return source
+	}
+	if size := len(data); size > 0 && (data[size-1] == 0 || data[size-1] == '\n') {
+		data = data[:size-1]
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return ""
+	}
+	var value string
+	if err := json.Unmarshal(fields[r.options.Key], &value); err != nil {
+		return string(fields[r.options.Key])
+	}
+	return value
+}
+
+// Allow returns true when the message received from the given
+// source is within the limits, else the message is counted as
+// dropped for the key of the message.
+func (r *RateLimiter) Allow(data []byte, source string) bool {
+	key, now := r.key(data, source), time.Now()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if now.Sub(r.pruned) >= rateLimitPruneInterval {
+		r.prune(now)
+	}
+	var entry *rateLimitEntry
+	if element, ok := r.entries[key]; ok {
+		r.order.MoveToFront(element)
+		entry = element.Value.(*rateLimitEntry)
+	} else {
+		if r.order.Len() >= r.options.MaxKeys {
+			r.remove(r.order.Back())
+		}
+		entry = &rateLimitEntry{
+			messages: tokenBucket{rate: r.options.Messages, burst: float64(r.options.MessageBurst), tokens: float64(r.options.MessageBurst), last: now},
+			bytes:    tokenBucket{rate: r.options.Bytes, burst: float64(r.options.ByteBurst), tokens: float64(r.options.ByteBurst), last: now},
+			dropped:  RateLimitSummary{Key: key},
+		}
+		r.entries[key] = r.order.PushFront(entry)
+	}
+	if entry.messages.take(1, now) {
+		if entry.bytes.take(float64(len(data)), now) {
+			return true
+		}
+		entry.messages.give(1)
+	}
+	entry.dropped.Messages++
+	entry.dropped.Bytes += uint64(len(data))
+	r.total.Messages++
+	r.total.Bytes += uint64(len(data))
+	return false
+}
+
+// remove will stop tracking the key of the given element
+func (r *RateLimiter) remove(element *list.Element) {
+	delete(r.entries, r.order.Remove(element).(*rateLimitEntry).dropped.Key)
+}
+
+// prune removes the keys that are idle, so their buckets are full again
+// and have no dropped messages that are not reported by Summary yet
+func (r *RateLimiter) prune(now time.Time) {
+	for element := r.order.Back(); element != nil; {
+		entry, prev := element.Value.(*rateLimitEntry), element.Prev()
+		if entry.dropped.Messages == 0 && entry.messages.full(now) && entry.bytes.full(now) {
+			r.remove(element)
+		}
+		element = prev
+	}
+	r.pruned = now
+}
+
+// Summary returns the keys that had messages dropped since the last
+// call and resets the counters, keys that are idle are removed.
+func (r *RateLimiter) Summary() []RateLimitSummary {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var summary []RateLimitSummary
+	for element := r.order.Front(); element != nil; element = element.Next() {
+		if entry := element.Value.(*rateLimitEntry); entry.dropped.Messages > 0 {
+			summary = append(summary, entry.dropped)
+			entry.dropped.Messages, entry.dropped.Bytes = 0, 0
+		}
+	}
+	r.prune(time.Now())
+	sort.Slice(summary, func(i, j int) bool { return summary[i].Messages > summary[j].Messages })
+	return summary
+}
+
+// Dropped returns the total amount of dropped messages and bytes
+func (r *RateLimiter) Dropped() (uint64, uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.total.Messages, r.total.Bytes
+}
+
+// NewRateLimiter creates a rate limiter, nil is returned when no limits
+// are set. A burst that is smaller than the rate is set to the rate.
+func NewRateLimiter(options *RateLimitOptions) *RateLimiter {
+	if options == nil || (options.Messages <= 0 && options.Bytes <= 0) {
+		return nil
+	}
+	options = &RateLimitOptions{
+		Key:          options.Key,
+		Messages:     options.Messages,
+		MessageBurst: options.MessageBurst,
+		Bytes:        options.Bytes,
+		ByteBurst:    options.ByteBurst,
+		MaxKeys:      options.MaxKeys,
+	}
+	if options.MaxKeys <= 0 {
+		options.MaxKeys = 10000
+	}
+	if options.Key == "" {
+		options.Key = "source"
+	}
+	if float64(options.MessageBurst) < options.Messages {
+		options.MessageBurst = int(options.Messages + 0.5)
+	}
+	if float64(options.ByteBurst) < options.Bytes {
+		options.ByteBurst = int(options.Bytes + 0.5)
+	}
+	return &RateLimiter{
+		options: options,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
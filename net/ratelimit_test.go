@@ -0,0 +1,69 @@
+package net
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_Allow(t *testing.T) {
+	limiter := NewRateLimiter(&RateLimitOptions{Key: "_app", Messages: 2, ByteBurst: 1000, Bytes: 1})
+	first, second := []byte(`{"_app":"first"}`), []byte(`{"_app":"second"}`)
+	if !limiter.Allow(first, "") || !limiter.Allow(first, "") {
+		t.Fatal("expected the messages within the burst to be allowed")
+	}
+	if limiter.Allow(first, "") {
+		t.Fatal("expected the message to be dropped when exceeding the burst")
+	}
+	if !limiter.Allow(second, "") {
+		t.Fatal("expected the limits to be applied per key")
+	}
+	summary := limiter.Summary()
+	if len(summary) != 1 || summary[0].Key != "first" || summary[0].Messages != 1 || summary[0].Bytes != uint64(len(first)) {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+	if len(limiter.Summary()) != 0 {
+		t.Fatal("expected the summary to be reset")
+	}
+	if messages, _ := limiter.Dropped(); messages != 1 {
+		t.Fatalf("expected 1 dropped message got %d", messages)
+	}
+	bytes := NewRateLimiter(&RateLimitOptions{Bytes: 10})
+	if !bytes.Allow(make([]byte, 10), "127.0.0.1:1000") || bytes.Allow(make([]byte, 1), "127.0.0.1:2000") {
+		t.Fatal("expected the byte limit to be applied on the source address without port")
+	}
+	if NewRateLimiter(&RateLimitOptions{Key: "host"}) != nil {
+		t.Fatal("expected no rate limiter without limits")
+	}
+}
+
+func TestRateLimiter_keys(t *testing.T) {
+	limiter := NewRateLimiter(&RateLimitOptions{Messages: 1, MaxKeys: 100})
+	for i := 0; i < 1000; i++ {
+		limiter.Allow(nil, fmt.Sprintf("10.0.%d.%d:1000", i/256, i%256))
+	}
+	if len(limiter.entries) != 100 || limiter.order.Len() != 100 {
+		t.Fatalf("expected the keys to be capped at 100 got %d", len(limiter.entries))
+	}
+	if _, ok := limiter.entries["10.0.3.231"]; !ok {
+		t.Fatal("expected the most recent key to be kept")
+	}
+	if _, ok := limiter.entries["10.0.0.0"]; ok {
+		t.Fatal("expected the least recent key to be removed")
+	}
+	// a key with dropped messages is kept till it is reported
+	limiter.Allow(nil, "10.0.3.231:1000")
+	// make all buckets full and the prune interval pass, so
+	// the idle keys are removed without calling Summary
+	for element := limiter.order.Front(); element != nil; element = element.Next() {
+		element.Value.(*rateLimitEntry).messages.last = time.Now().Add(-time.Minute)
+	}
+	limiter.pruned = time.Now().Add(-time.Minute)
+	limiter.Allow(nil, "127.0.0.1:1000")
+	if len(limiter.entries) != 2 {
+		t.Fatalf("expected the idle keys to be removed got %d keys", len(limiter.entries))
+	}
+	if summary := limiter.Summary(); len(summary) != 1 || summary[0].Key != "10.0.3.231" {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+}
@@ -0,0 +1,145 @@
+package net
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pbergman/logger"
+)
+
+// Resolver will cache the addresses of the remotes for the given ttl so
+// a change of address (like from a load balancer) is picked up on new
+// connections without the need of a restart.
+type Resolver struct {
+	ttl    time.Duration
+	cache  map[string]*resolverEntry
+	lock   sync.Mutex
+	lookup func(ctx context.Context, host string) ([]net.IPAddr, error)
+	logger *logger.Logger
+}
+
+type resolverEntry struct {
+	addresses []net.IP
+	expires   time.Time
+	// pending is closed when the running lookup of the
+	// host is done so the host is resolved only once
+	pending chan struct{}
+}
+
+// Lookup will return the (cached) addresses for the given host, when the
+// lookup fails and there are addresses from a previous lookup those will
+// be returned so a dns hiccup does not stop us from connecting. The lock
+// is not held while resolving so a slow lookup does not block the lookups
+// of other hosts.
+func (r *Resolver) Lookup(ctx context.Context, host string) ([]net.IP, error) {
+	r.lock.Lock()
+	entry, ok := r.cache[host]
+	if !ok {
+		entry = new(resolverEntry)
+		r.cache[host] = entry
+	}
+	if addresses := entry.addresses; time.Now().Before(entry.expires) {
+		r.lock.Unlock()
+		return addresses, nil
+	}
+	if pending := entry.pending; pending != nil {
+		r.lock.Unlock()
+		select {
+		case <-pending:
+			return r.Lookup(ctx, host)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	pending := make(chan struct{})
+	entry.pending = pending
+	r.lock.Unlock()
+	records, err := r.lookup(ctx, host)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	entry.pending = nil
+	close(pending)
+	if err != nil {
+		if len(entry.addresses) > 0 {
+			r.logger.Warning(logf(logFields{"host": host, "error": err.Error()}, "failed to resolve '%s', using previous addresses: %s", host, err.Error()))
+			return entry.addresses, nil
+		}
+		return nil, err
+	}
+	addresses := make([]net.IP, len(records))
+	for i, record := range records {
+		addresses[i] = record.IP
+	}
+	if len(entry.addresses) == 0 {
+		r.logger.Debug(logf(logFields{"host": host, "addresses": formatAddresses(addresses)}, "resolved '%s' to %s", host, formatAddresses(addresses)))
+	} else if formatAddresses(entry.addresses) != formatAddresses(addresses) {
+		r.logger.Notice(logf(logFields{"host": host, "addresses": formatAddresses(addresses)}, "addresses of '%s' changed from %s to %s", host, formatAddresses(entry.addresses), formatAddresses(addresses)))
+	}
+	entry.addresses = addresses
+	entry.expires = time.Now().Add(r.ttl)
+	return addresses, nil
+}
+
+// Invalidate will expire the cached addresses of the given host
+// so the next lookup (on reconnect) will resolve the host again.
+func (r *Resolver) Invalidate(host string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if entry, ok := r.cache[host]; ok {
+		entry.expires = time.Time{}
+	}
+}
+
+// formatAddresses returns a sorted list of the addresses so
+// it can be used for logging and comparing lookups.
+func formatAddresses(addresses []net.IP) string {
+	list := make([]string, len(addresses))
+	for i, address := range addresses {
+		list[i] = address.String()
+	}
+	sort.Strings(list)
+	return "[" + strings.Join(list, ", ") + "]"
+}
+
+// sortAddresses will filter the addresses for the given network and order
+// them alternating between the address families, starting with the family
+// of the first address as described in RFC 8305 (happy eyeballs).
+func sortAddresses(network string, addresses []net.IP) []net.IP {
+	var primary, fallback []net.IP
+	for _, address := range addresses {
+		isV4 := address.To4() != nil
+		if (network == "tcp4" && !isV4) || (network == "tcp6" && isV4) {
+			continue
+		}
+		if len(primary) == 0 || (primary[0].To4() != nil) == isV4 {
+			primary = append(primary, address)
+		} else {
+			fallback = append(fallback, address)
+		}
+	}
+	sorted := make([]net.IP, 0, len(primary)+len(fallback))
+	for i := 0; i < len(primary) || i < len(fallback); i++ {
+		if i < len(primary) {
+			sorted = append(sorted, primary[i])
+		}
+		if i < len(fallback) {
+			sorted = append(sorted, fallback[i])
+		}
+	}
+	return sorted
+}
+
+// NewResolver creates a resolver that will cache the addresses for the given
+// ttl, with a ttl of 0 the host will be resolved on every new connection.
+func NewResolver(ttl time.Duration, logger *logger.Logger) *Resolver {
+	return &Resolver{
+		ttl:    ttl,
+		cache:  make(map[string]*resolverEntry),
+		lookup: net.DefaultResolver.LookupIPAddr,
+		logger: logger,
+	}
+}
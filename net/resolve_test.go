@@ -0,0 +1,109 @@
+package net
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pbergman/logger"
+)
+
+func TestSortAddresses(t *testing.T) {
+	addresses := []net.IP{
+		net.ParseIP("::1"),
+		net.ParseIP("::2"),
+		net.ParseIP("10.0.0.1"),
+		net.ParseIP("::3"),
+		net.ParseIP("10.0.0.2"),
+	}
+	for network, expected := range map[string]string{
+		"tcp":  "::1 10.0.0.1 ::2 10.0.0.2 ::3",
+		"tcp4": "10.0.0.1 10.0.0.2",
+		"tcp6": "::1 ::2 ::3",
+	} {
+		var result string
+		for i, address := range sortAddresses(network, addresses) {
+			if i > 0 {
+				result += " "
+			}
+			result += address.String()
+		}
+		if result != expected {
+			t.Fatalf("expected '%s' for %s got '%s'", expected, network, result)
+		}
+	}
+}
+
+func TestDialer_dialAddresses(t *testing.T) {
+	echo := newTestEchoServer(t)
+	defer echo.Close()
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+	dialer := new(Dialer)
+	// 127.0.0.2 should refuse the connection because
+	// the echo server only listens on 127.0.0.1
+	conn, err := dialer.dialAddresses(context.Background(), "tcp", []net.IP{net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.1")}, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if _, err := dialer.dialAddresses(context.Background(), "tcp", []net.IP{net.ParseIP("127.0.0.2")}, port); err == nil {
+		t.Fatal("expected an error when no address could be connected")
+	}
+}
+
+func TestResolver_Lookup(t *testing.T) {
+	var calls int32
+	var slow = make(chan struct{})
+	resolver := NewResolver(time.Minute, logger.NewLogger("test"))
+	resolver.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		atomic.AddInt32(&calls, 1)
+		if host == "slow" {
+			select {
+			case <-slow:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, nil
+	}
+	if _, err := resolver.Lookup(context.Background(), "fast"); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if addresses, err := resolver.Lookup(context.Background(), "slow"); err != nil || len(addresses) != 1 {
+				t.Errorf("expected the addresses of the slow host got %v (%v)", addresses, err)
+			}
+		}()
+	}
+	for atomic.LoadInt32(&calls) != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	done := make(chan struct{})
+	go func() {
+		resolver.Lookup(context.Background(), "fast")
+		resolver.Lookup(context.Background(), "other")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the lookups of other hosts not to wait for the slow lookup")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := resolver.Lookup(ctx, "slow"); err == nil {
+		t.Fatal("expected a canceled lookup to stop waiting for the slow lookup")
+	}
+	close(slow)
+	wg.Wait()
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Fatalf("expected every host to be resolved once, got %d lookups", n)
+	}
+}
@@ -0,0 +1,46 @@
+package net
+
+import (
+	"encoding/json"
+)
+
+// Route sends the messages that match the filter to the pools, a
+// route without pools will drop the matching messages
+type Route struct {
+	Filter *TailFilter
+	Pools  []ConnPoolInterface
+}
+
+// Router selects the pools a message is delivered to, the routes are
+// checked in order and the first matching route is used. A message that
+// matches no route is dropped and without routes every message is sent
+// to all pools.
+type Router struct {
+	routes []*Route
+	pools  []ConnPoolInterface
+}
+
+// Pools returns the pools the given message should be delivered to
+func (r *Router) Pools(message []byte) []ConnPoolInterface {
+	if len(r.routes) == 0 {
+		return r.pools
+	}
+	var fields map[string]interface{}
+	if size := len(message); size > 0 && (message[size-1] == 0 || message[size-1] == '\n') {
+		message = message[:size-1]
+	}
+	if err := json.Unmarshal(message, &fields); err != nil {
+		// not a GELF (JSON) message so it only matches the routes without a filter
+		fields = nil
+	}
+	for _, route := range r.routes {
+		if route.Filter == nil || route.Filter.empty() || fields != nil && route.Filter.match(fields) {
+			return route.Pools
+		}
+	}
+	return nil
+}
+
+func NewRouter(pools []ConnPoolInterface, routes ...*Route) *Router {
+	return &Router{pools: pools, routes: routes}
+}
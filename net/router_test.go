@@ -0,0 +1,40 @@
+package net
+
+import (
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	alerts, apps, other := new(testPool), new(testPool), new(testPool)
+	pools := []ConnPoolInterface{alerts, apps, other}
+	if out := NewRouter(pools).Pools([]byte(`{"level":7}`)); len(out) != 3 {
+		t.Fatalf("expected a message to be sent to all pools without routes, got %d pools", len(out))
+	}
+	router := NewRouter(
+		pools,
+		&Route{Filter: &TailFilter{Level: 3}, Pools: []ConnPoolInterface{alerts, apps}},
+		&Route{Filter: &TailFilter{Level: -1, Fields: map[string]string{"_app": "api-*"}}, Pools: []ConnPoolInterface{apps}},
+		&Route{Filter: &TailFilter{Level: -1, Host: "debug-*"}},
+		&Route{Filter: &TailFilter{Level: -1}, Pools: []ConnPoolInterface{other}},
+	)
+	for message, expected := range map[string][]ConnPoolInterface{
+		`{"level":2,"_app":"api-v1"}` + "\x00": {alerts, apps},
+		`{"level":6,"_app":"api-v1"}`:          {apps},
+		`{"level":6,"host":"debug-01"}`:        nil,
+		`{"level":6,"host":"web-01"}` + "\n":   {other},
+		`not a gelf message`:                   {other},
+	} {
+		out := router.Pools([]byte(message))
+		if len(out) != len(expected) {
+			t.Fatalf("expected %d pools for %s got %d", len(expected), message, len(out))
+		}
+		for i := range out {
+			if out[i] != expected[i] {
+				t.Fatalf("expected pool %d for %s to match", i, message)
+			}
+		}
+	}
+	if out := NewRouter(pools, &Route{Filter: &TailFilter{Level: 3}, Pools: pools}).Pools([]byte(`{"level":6}`)); out != nil {
+		t.Fatal("expected a message that matches no route to be dropped")
+	}
+}
@@ -0,0 +1,119 @@
+package net
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PoolState holds the state of a pool as reported by the health endpoints
+type PoolState struct {
+	Remote string `json:"remote"`
+	// Healthy is true when the pool is not halted and it has an open
+	// connection or a successful delivery after the last failure
+	Healthy     bool `json:"healthy"`
+	Halted      bool `json:"halted"`
+	Paused      bool `json:"paused"`
+	Connections int  `json:"connections"`
+	Queued      int  `json:"queued"`
+	QueueSize   int  `json:"queue_size"`
+	// Levels holds the amount of queued messages per GELF level
+	Levels []int `json:"queued_levels"`
+	// Delivered, Retried and Discarded are the amount of
+	// messages since the start of the pool, Delivered does
+	// not count the messages created by the proxy itself
+	Delivered    uint64     `json:"delivered"`
+	Retried      uint64     `json:"retried"`
+	Discarded    uint64     `json:"discarded"`
+	LastDelivery *time.Time `json:"last_delivery,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+	LastErrorAt  *time.Time `json:"last_error_at,omitempty"`
+}
+
+// ListenerState holds the state of a listener as reported by the health endpoints
+type ListenerState struct {
+	Address  string `json:"address"`
+	Bound    bool   `json:"bound"`
+	Received uint64 `json:"received"`
+	Rejected uint64 `json:"rejected"`
+	Limited  uint64 `json:"rate_limited"`
+	// Dropped is the amount of packets dropped because of the memory
+	// budget and the chunked messages that expired before completion
+	Dropped uint64 `json:"dropped"`
+}
+
+// connState tracks the connections and the result of
+// the last deliveries of a pool for the health endpoints
+type connState struct {
+	connections  int32
+	delivered    uint64
+	retried      uint64
+	discarded    uint64
+	lock         sync.Mutex
+	lastDelivery time.Time
+	lastErrorAt  time.Time
+	lastError    error
+}
+
+func (c *connState) connected() {
+	atomic.AddInt32(&c.connections, 1)
+}
+
+func (c *connState) disconnected() {
+	atomic.AddInt32(&c.connections, -1)
+}
+
+// success will record a delivery, the internal messages (like
+// a heartbeat) are not counted so delivered only holds the
+// messages that were received by the listeners
+func (c *connState) success(internal bool) {
+	if !internal {
+		atomic.AddUint64(&c.delivered, 1)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lastDelivery = time.Now()
+}
+
+func (c *connState) failure(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lastError, c.lastErrorAt = err, time.Now()
+}
+
+// track will wrap the connection so it is counted till it is closed
+func (c *connState) track(conn net.Conn) net.Conn {
+	c.connected()
+	return &trackedConn{Conn: conn, closed: c.disconnected}
+}
+
+func (c *connState) state(state *PoolState) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	state.Connections = int(atomic.LoadInt32(&c.connections))
+	state.Delivered = atomic.LoadUint64(&c.delivered)
+	state.Retried = atomic.LoadUint64(&c.retried)
+	state.Discarded = atomic.LoadUint64(&c.discarded)
+	if !c.lastDelivery.IsZero() {
+		last := c.lastDelivery
+		state.LastDelivery = &last
+	}
+	if c.lastError != nil {
+		last := c.lastErrorAt
+		state.LastError, state.LastErrorAt = c.lastError.Error(), &last
+	}
+	state.Healthy = !state.Halted && (state.Connections > 0 || (!c.lastDelivery.IsZero() && c.lastDelivery.After(c.lastErrorAt)))
+}
+
+// trackedConn will call closed once when the connection is closed
+type trackedConn struct {
+	net.Conn
+	once   sync.Once
+	closed func()
+}
+
+func (t *trackedConn) Close() error {
+	t.once.Do(t.closed)
+	return t.Conn.Close()
+}
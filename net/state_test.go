@@ -0,0 +1,35 @@
+package net
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestConnState_state(t *testing.T) {
+	var state connState
+	var report PoolState
+	if state.state(&report); report.Healthy {
+		t.Fatal("expected a pool without a connection or delivery not to be healthy")
+	}
+	state.failure(errors.New("connection refused"))
+	if state.state(&report); report.Healthy || report.LastError != "connection refused" {
+		t.Fatalf("expected a failed pool to be unhealthy, got %+v", report)
+	}
+	conn := state.track(&testConn{})
+	if state.state(&report); !report.Healthy || report.Connections != 1 {
+		t.Fatalf("expected a pool with a connection to be healthy, got %+v", report)
+	}
+	conn.Close()
+	conn.Close()
+	if state.state(&report); report.Healthy || report.Connections != 0 {
+		t.Fatalf("expected the closed connection to be counted once, got %+v", report)
+	}
+	state.success(true)
+	if state.state(&report); !report.Healthy || report.Delivered != 0 {
+		t.Fatalf("expected an internal delivery to be healthy but not counted, got %+v", report)
+	}
+	state.success(false)
+	if state.state(&report); !report.Healthy || report.Delivered != 1 {
+		t.Fatalf("expected a pool with a delivery after the failure to be healthy, got %+v", report)
+	}
+}
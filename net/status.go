@@ -0,0 +1,158 @@
+package net
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pbergman/logger"
+)
+
+// StatusServer is a http server that exposes the status of the proxy,
+// the metrics on /metrics and the health of the listeners and pools
+// on /healthz (alive and listening) and /readyz (able to deliver).
+type StatusServer struct {
+	mux       *http.ServeMux
+	server    *http.Server
+	logger    *logger.Logger
+	lock      sync.RWMutex
+	listeners []*Listener
+	pools     []ConnPoolInterface
+	// QueueThreshold is the fraction of the queue size a pool
+	// can have queued before it is reported as not ready
+	QueueThreshold float64
+}
+
+// StatusReport is the body returned by the health endpoints
+type StatusReport struct {
+	Status    string          `json:"status"`
+	Listeners []ListenerState `json:"listeners"`
+	Pools     []PoolState     `json:"pools"`
+}
+
+// AddListener will add the listener to the health endpoints
+func (s *StatusServer) AddListener(listener *Listener) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.listeners = append(s.listeners, listener)
+}
+
+// AddPool will add the pool to the health endpoints
+func (s *StatusServer) AddPool(pool ConnPoolInterface) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pools = append(s.pools, pool)
+}
+
+// RemoveListener will remove the listener from the health endpoints
+func (s *StatusServer) RemoveListener(listener *Listener) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i := range s.listeners {
+		if s.listeners[i] == listener {
+			s.listeners = append(s.listeners[:i:i], s.listeners[i+1:]...)
+			return
+		}
+	}
+}
+
+// RemovePool will remove the pool from the health endpoints
+func (s *StatusServer) RemovePool(pool ConnPoolInterface) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i := range s.pools {
+		if s.pools[i] == pool {
+			s.pools = append(s.pools[:i:i], s.pools[i+1:]...)
+			return
+		}
+	}
+}
+
+// report collects the state of the listeners and pools and returns true
+// when all listeners are bound and (when ready is set) all pools are
+// healthy with a queue below the threshold.
+func (s *StatusServer) report(ready bool) (*StatusReport, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	report := &StatusReport{
+		Listeners: make([]ListenerState, 0, len(s.listeners)),
+		Pools:     make([]PoolState, 0, len(s.pools)),
+	}
+	ok := len(s.listeners) > 0
+	for _, listener := range s.listeners {
+		state := listener.State()
+		ok = ok && state.Bound
+		report.Listeners = append(report.Listeners, state)
+	}
+	for _, pool := range s.pools {
+		state := pool.State()
+		if ready {
+			ok = ok && state.Healthy && float64(state.Queued) < s.QueueThreshold*float64(state.QueueSize)
+		}
+		report.Pools = append(report.Pools, state)
+	}
+	report.Status = "ok"
+	if !ok {
+		report.Status = "failing"
+	}
+	return report, ok
+}
+
+func (s *StatusServer) health(ready bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report, ok := s.report(ready)
+		w.Header().Set("Content-Type", "application/json")
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			s.logger.Debug(fmt.Sprintf("failed to write status: %s", err.Error()))
+		}
+	}
+}
+
+func (s *StatusServer) metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := WriteMetrics(w); err != nil {
+		s.logger.Debug(fmt.Sprintf("failed to write metrics: %s", err.Error()))
+	}
+}
+
+// Handle will register the handler for the given pattern
+func (s *StatusServer) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+func (s *StatusServer) Close() error {
+	return s.server.Close()
+}
+
+// NewStatusServer will create and start the status server on the given address
+func NewStatusServer(address string, logger *logger.Logger) (*StatusServer, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	server := &StatusServer{
+		mux:            http.NewServeMux(),
+		logger:         logger,
+		QueueThreshold: 0.9,
+	}
+	server.mux.HandleFunc("/metrics", server.metrics)
+	server.mux.Handle("/healthz", server.health(false))
+	server.mux.Handle("/readyz", server.health(true))
+	server.server = &http.Server{
+		Handler:           server.mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := server.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Error(fmt.Sprintf("status server stopped: %s", err.Error()))
+		}
+	}()
+	logger.Debug(fmt.Sprintf("serving status on 'http://%s'", listener.Addr().String()))
+	return server, nil
+}
@@ -0,0 +1,179 @@
+package net
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// TailFilter selects the messages that are streamed to a tail subscriber
+type TailFilter struct {
+	// Level is the least severe level that is passed, -1 for all
+	Level int
+	// Host is a pattern (see path.Match) for the host of the message
+	Host string
+	// Fields holds the patterns for the values of the given fields
+	Fields map[string]string
+}
+
+// Args returns the filter as arguments for the tail admin command
+func (f *TailFilter) Args() []string {
+	var args []string
+	if f.Level >= 0 {
+		args = append(args, "level="+strconv.Itoa(f.Level))
+	}
+	if f.Host != "" {
+		args = append(args, "host="+f.Host)
+	}
+	for name, pattern := range f.Fields {
+		args = append(args, name+"="+pattern)
+	}
+	return args
+}
+
+func (f *TailFilter) empty() bool {
+	return f.Level < 0 && f.Host == "" && len(f.Fields) == 0
+}
+
+func matchValue(pattern string, value interface{}) bool {
+	var str string
+	switch value := value.(type) {
+	case nil:
+		return false
+	case string:
+		str = value
+	default:
+		str = fmt.Sprint(value)
+	}
+	ok, _ := path.Match(pattern, str)
+	return ok
+}
+
+func (f *TailFilter) match(fields map[string]interface{}) bool {
+	if f.Level >= 0 {
+		level := 1
+		if value, ok := fields["level"].(float64); ok {
+			level = int(value)
+		}
+		if level > f.Level {
+			return false
+		}
+	}
+	if f.Host != "" && !matchValue(f.Host, fields["host"]) {
+		return false
+	}
+	for name, pattern := range f.Fields {
+		if !matchValue(pattern, fields[name]) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseTailFilter will create a filter from arguments like level=4,
+// host=web-* or _app=api where the value of the host and fields is a
+// pattern as supported by path.Match.
+func ParseTailFilter(args []string) (*TailFilter, error) {
+	filter := &TailFilter{Level: -1, Fields: make(map[string]string)}
+	for _, arg := range args {
+		index := strings.Index(arg, "=")
+		if index <= 0 {
+			return nil, fmt.Errorf("invalid filter '%s', expected name=value", arg)
+		}
+		name, value := arg[:index], arg[index+1:]
+		if _, err := path.Match(value, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern '%s': %s", value, err.Error())
+		}
+		switch name {
+		case "level":
+			level, err := strconv.Atoi(value)
+			if err != nil || level < 0 || level > 7 {
+				return nil, fmt.Errorf("invalid level '%s', expected 0 till 7", value)
+			}
+			filter.Level = level
+		case "host":
+			filter.Host = value
+		default:
+			filter.Fields[name] = value
+		}
+	}
+	return filter, nil
+}
+
+// TailMessage is a message as streamed to a tail subscriber
+type TailMessage struct {
+	Id      string          `json:"id"`
+	Message json.RawMessage `json:"message"`
+	// Dropped is the amount of messages that were dropped before
+	// this message because the subscriber could not keep up
+	Dropped uint64 `json:"dropped,omitempty"`
+}
+
+type tapSubscriber struct {
+	filter   *TailFilter
+	messages chan *TailMessage
+	dropped  uint64
+}
+
+// Tap passes the messages that flow through the proxy to the tail
+// subscribers, a slow subscriber will miss messages so it never
+// blocks the delivery. A nil tap will ignore all messages.
+type Tap struct {
+	lock        sync.RWMutex
+	subscribers map[*tapSubscriber]struct{}
+	active      int32
+}
+
+// Subscribe returns a channel that receives the messages matching the
+// filter, the returned function should be called to stop receiving.
+func (t *Tap) Subscribe(filter *TailFilter) (<-chan *TailMessage, func()) {
+	subscriber := &tapSubscriber{filter: filter, messages: make(chan *TailMessage, 256)}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.subscribers[subscriber] = struct{}{}
+	atomic.StoreInt32(&t.active, int32(len(t.subscribers)))
+	return subscriber.messages, func() {
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		delete(t.subscribers, subscriber)
+		atomic.StoreInt32(&t.active, int32(len(t.subscribers)))
+	}
+}
+
+// Publish will pass the message with the given proxy id to the subscribers
+func (t *Tap) Publish(id []byte, message []byte) {
+	if t == nil || atomic.LoadInt32(&t.active) == 0 {
+		return
+	}
+	if size := len(message); size > 0 && (message[size-1] == 0 || message[size-1] == '\n') {
+		message = message[:size-1]
+	}
+	var fields map[string]interface{}
+	var raw = json.RawMessage(message)
+	if err := json.Unmarshal(message, &fields); err != nil {
+		// not a GELF (JSON) message so it can not be filtered
+		raw, _ = json.Marshal(string(message))
+	}
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	for subscriber := range t.subscribers {
+		if fields == nil && !subscriber.filter.empty() || fields != nil && !subscriber.filter.match(fields) {
+			continue
+		}
+		dropped := atomic.LoadUint64(&subscriber.dropped)
+		select {
+		case subscriber.messages <- &TailMessage{Id: fmt.Sprintf("%X", id), Message: raw, Dropped: dropped}:
+			atomic.AddUint64(&subscriber.dropped, ^(dropped - 1))
+		default:
+			atomic.AddUint64(&subscriber.dropped, 1)
+		}
+	}
+}
+
+func NewTap() *Tap {
+	return &Tap{subscribers: make(map[*tapSubscriber]struct{})}
+}
@@ -0,0 +1,35 @@
+package net
+
+import "testing"
+
+func TestTap_Publish(t *testing.T) {
+	tap := NewTap()
+	filter, err := ParseTailFilter([]string{"level=3", "host=web-*", "_app=api"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, cancel := tap.Subscribe(filter)
+	for _, message := range []string{
+		`{"host":"web-1","level":6,"_app":"api"}`,
+		`{"host":"db-1","level":3,"_app":"api"}`,
+		`{"host":"web-1","level":3,"_app":"web"}`,
+		`not a gelf message`,
+		`{"host":"web-2","level":2,"_app":"api"}`,
+	} {
+		tap.Publish([]byte{1}, []byte(message+"\x00"))
+	}
+	if size := len(messages); size != 1 {
+		t.Fatalf("expected 1 matching message got %d", size)
+	}
+	if message := <-messages; message.Id != "01" || string(message.Message) != `{"host":"web-2","level":2,"_app":"api"}` {
+		t.Fatalf("unexpected message %s %s", message.Id, message.Message)
+	}
+	cancel()
+	tap.Publish([]byte{1}, []byte(`{"host":"web-2","level":2,"_app":"api"}`))
+	if len(messages) != 0 {
+		t.Fatal("expected no messages after cancel")
+	}
+	if _, err := ParseTailFilter([]string{"level=8"}); err == nil {
+		t.Fatal("expected an error for an invalid level")
+	}
+}
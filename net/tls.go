@@ -0,0 +1,502 @@
+package net
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pbergman/logger"
+)
+
+// TlsOptions holds the settings used for creating
+// the tls config for the secure remotes
+type TlsOptions struct {
+	// CA is the file (or bundle) with the CA certificate(s) or a
+	// directory with files containing the CA certificates
+	CA string
+	// Crt and Pem are the files for the client certificate and key
+	Crt string
+	Pem string
+	// NoClientAuth will skip loading the client certificate and
+	// makes the CA optional (the system roots are used when the
+	// CA does not exist)
+	NoClientAuth bool
+	// ServerName overrides the name used for verifying the remote
+	// certificate, for when connecting by ip to a certificate that
+	// was issued for a dns name
+	ServerName string
+	// MinVersion is the minimum tls version, see ParseTlsVersion
+	MinVersion uint16
+	// CipherSuites is the list of enabled cipher suites for tls
+	// version 1.2 and lower, see ParseCipherSuites
+	CipherSuites []uint16
+	// SystemRoots will merge the system root certificates with
+	// the certificates loaded from the CA
+	SystemRoots bool
+	// InsecureSkipVerify disables the verification of the remote
+	// certificate and should only be used for lab setups
+	InsecureSkipVerify bool
+	// SessionCacheSize is the amount of tls sessions that are
+	// cached for resumption so reconnects stay cheap, 0 disables
+	// session resumption
+	SessionCacheSize int
+	// ReloadInterval is the interval on which the certificate
+	// files are checked for changes, 0 disables the watcher
+	ReloadInterval time.Duration
+	// Pins holds the (base64 encoded) SHA-256 hashes of the
+	// public key (SPKI) of the remote, the connection is only
+	// accepted when one of the certificates of the verified chain
+	// (or the certificate of the remote when the verification is
+	// disabled) matches one of the pins. See ParsePin for the format.
+	Pins []string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTlsVersion will return the tls version for the given
+// string (1.0, 1.1, 1.2 or 1.3) an empty string returns 0
+// which will result in the default min version.
+func ParseTlsVersion(version string) (uint16, error) {
+	if version == "" {
+		return 0, nil
+	}
+	if v, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(version), "tls")]; ok {
+		return v, nil
+	}
+	return 0, errors.New("unsupported tls version '" + version + "', expected 1.0, 1.1, 1.2 or 1.3")
+}
+
+// ParseCipherSuites will return the ids of the given cipher suite names
+// (as named in the crypto/tls package like TLS_AES_128_GCM_SHA256)
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	var suites []uint16
+	var available = append(tls.CipherSuites(), tls.InsecureCipherSuites()...)
+	for _, name := range names {
+		var found bool
+		for _, suite := range available {
+			if strings.EqualFold(suite.Name, name) {
+				suites = append(suites, suite.ID)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, errors.New("unsupported cipher suite '" + name + "'")
+		}
+	}
+	return suites, nil
+}
+
+// ParsePin will decode the given pin that should be a base64 encoded SHA-256
+// hash of the public key (SPKI) optionally prefixed with "sha256/". A pin
+// for a certificate can be created with:
+//
+//	openssl x509 -in Server.crt -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+func ParsePin(pin string) ([]byte, error) {
+	raw := strings.TrimLeft(strings.TrimPrefix(strings.TrimSpace(pin), "sha256/"), "/")
+	hash, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil || len(hash) != sha256.Size {
+		return nil, errors.New("invalid pin '" + pin + "', expected a base64 encoded SHA-256 hash")
+	}
+	return hash, nil
+}
+
+// readCertificates will read all pem encoded certificates from the
+// given file or all files in the given directory.
+func readCertificates(name string) ([]*x509.Certificate, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	var files = []string{name}
+	if info.IsDir() {
+		if files, err = filepath.Glob(filepath.Join(name, "*")); err != nil {
+			return nil, err
+		}
+	}
+	var certificates []*x509.Certificate
+	for _, file := range files {
+		if info, err := os.Stat(file); err != nil || info.IsDir() {
+			continue
+		}
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for block, rest := pem.Decode(buf); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			certificate, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse certificate from '%s': %s", file, err.Error())
+			}
+			certificates = append(certificates, certificate)
+		}
+	}
+	if len(certificates) == 0 {
+		return nil, errors.New("no certificates found in '" + name + "'")
+	}
+	return certificates, nil
+}
+
+// newCertPool will create the pool used for verifying the remote, when
+// nil is returned the system roots should be used.
+func newCertPool(options *TlsOptions, logger *logger.Logger) (*x509.CertPool, error) {
+	certificates, err := readCertificates(options.CA)
+	switch {
+	case err == nil:
+		logger.Debug(fmt.Sprintf("loaded %d ca root certificate(s) from '%s'", len(certificates), options.CA))
+	case options.NoClientAuth && os.IsNotExist(err):
+		logger.Debug(fmt.Sprintf("no ca root certificate found at '%s', using system root certificates", options.CA))
+		return nil, nil
+	default:
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if options.SystemRoots {
+		if pool, err = x509.SystemCertPool(); err != nil {
+			return nil, err
+		}
+		logger.Debug("merged ca root certificate(s) with the system root certificates")
+	}
+	for _, certificate := range certificates {
+		pool.AddCert(certificate)
+	}
+	return pool, nil
+}
+
+// newKeyPair will load the client certificate and private key
+func newKeyPair(options *TlsOptions, logger *logger.Logger) (*tls.Certificate, error) {
+	pair, err := tls.LoadX509KeyPair(options.Crt, options.Pem)
+	if err != nil {
+		return nil, err
+	}
+	if pair.Leaf == nil {
+		if pair.Leaf, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	logger.Debug(fmt.Sprintf("loaded certificate: '%s'", options.Crt))
+	logger.Debug(fmt.Sprintf("loaded private key: '%s'", options.Pem))
+	return &pair, nil
+}
+
+// TlsCheck holds the certificates that are loaded by CheckTls
+type TlsCheck struct {
+	// Roots are the certificates loaded from the CA, this
+	// is empty when the system root certificates are used
+	Roots []*x509.Certificate
+	// Certificate is the client certificate, nil when
+	// no client certificate is presented to the remote
+	Certificate *x509.Certificate
+}
+
+// CheckTls will load the certificates the same way as NewTlsLoader and
+// verifies the client certificate (and key) against the CA certificates
+// so a mismatch is found before connecting to the remote.
+func CheckTls(options *TlsOptions, logger *logger.Logger) (*TlsCheck, error) {
+	var check = new(TlsCheck)
+	var roots *x509.CertPool
+	var err error
+	for _, pin := range options.Pins {
+		if _, err := ParsePin(pin); err != nil {
+			return nil, err
+		}
+	}
+	if !options.InsecureSkipVerify {
+		if roots, err = newCertPool(options, logger); err != nil {
+			return nil, err
+		}
+		if roots != nil {
+			if check.Roots, err = readCertificates(options.CA); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if options.NoClientAuth {
+		return check, nil
+	}
+	pair, err := newKeyPair(options, logger)
+	if err != nil {
+		return nil, err
+	}
+	check.Certificate = pair.Leaf
+	if roots != nil {
+		verify := x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: x509.NewCertPool(),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		for _, raw := range pair.Certificate[1:] {
+			if certificate, err := x509.ParseCertificate(raw); err == nil {
+				verify.Intermediates.AddCert(certificate)
+			}
+		}
+		if _, err := pair.Leaf.Verify(verify); err != nil {
+			return nil, fmt.Errorf("certificate '%s' is not valid for the ca '%s': %s", options.Crt, options.CA, err.Error())
+		}
+	}
+	return check, nil
+}
+
+// TlsLoader holds the client certificate and CA root certificates
+// used by the secure pools. The certificates can be reloaded (see
+// Reload and Watch) and new connections will use the new certificates
+// without disturbing the active connections.
+type TlsLoader struct {
+	options  *TlsOptions
+	pins     [][]byte
+	config   *tls.Config
+	pair     atomic.Value
+	roots    atomic.Value
+	modified map[string]time.Time
+	lock     sync.Mutex
+	done     chan struct{}
+	logger   *logger.Logger
+}
+
+// Config returns the tls config that should be used for new connections
+// to the given host. The remote certificate is verified for the server
+// name of the options or, when not set, for the host (which can be an ip).
+func (t *TlsLoader) Config(host string) *tls.Config {
+	var name = t.options.ServerName
+	if name == "" {
+		name = host
+	}
+	config := t.config.Clone()
+	config.ServerName = name
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		return t.verifyConnection(state, name)
+	}
+	return config
+}
+
+// Certificate returns the current client certificate, nil
+// when no client certificate is used
+func (t *TlsLoader) Certificate() *x509.Certificate {
+	if pair, ok := t.pair.Load().(*tls.Certificate); ok && pair != nil {
+		return pair.Leaf
+	}
+	return nil
+}
+
+func (t *TlsLoader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return t.pair.Load().(*tls.Certificate), nil
+}
+
+// verifyConnection will verify the remote certificate chain against the
+// current root certificates, this replaces the default verification of
+// the tls package because the root certificates can change on a reload.
+// The name is passed because the server name of the state is empty for
+// an ip, the tls package does not send an ip as server name (SNI).
+//
+// The pins are only matched against the verified chains (or the leaf
+// when the verification is disabled) and not against all certificates
+// the remote sent, these can contain any certificate.
+func (t *TlsLoader) verifyConnection(state tls.ConnectionState, name string) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("tls: remote did not provide a certificate")
+	}
+	if t.options.InsecureSkipVerify {
+		return t.verifyPins(state.PeerCertificates[:1])
+	}
+	options := x509.VerifyOptions{
+		DNSName:       name,
+		Intermediates: x509.NewCertPool(),
+	}
+	if roots, ok := t.roots.Load().(*x509.CertPool); ok {
+		options.Roots = roots
+	}
+	for _, certificate := range state.PeerCertificates[1:] {
+		options.Intermediates.AddCert(certificate)
+	}
+	chains, err := state.PeerCertificates[0].Verify(options)
+	if err != nil {
+		return err
+	}
+	for _, chain := range chains {
+		if err = t.verifyPins(chain); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// verifyPins will check if one of the certificates of the remote
+// matches one of the pins, when no pins are configured it will
+// always return nil.
+func (t *TlsLoader) verifyPins(certificates []*x509.Certificate) error {
+	if len(t.pins) == 0 {
+		return nil
+	}
+	var hashes = make([]string, len(certificates))
+	for i, certificate := range certificates {
+		hash := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+		for _, pin := range t.pins {
+			if subtle.ConstantTimeCompare(pin, hash[:]) == 1 {
+				return nil
+			}
+		}
+		hashes[i] = base64.StdEncoding.EncodeToString(hash[:])
+	}
+	return &PinError{Hashes: hashes}
+}
+
+// files returns the files that are used by the loader
+func (t *TlsLoader) files() []string {
+	var files = []string{t.options.CA}
+	if !t.options.NoClientAuth {
+		files = append(files, t.options.Crt, t.options.Pem)
+	}
+	return files
+}
+
+// changed will check if one of the files has been modified
+// since the last check and updates the modification times
+func (t *TlsLoader) changed() bool {
+	var changed bool
+	for _, file := range t.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if last, ok := t.modified[file]; ok && !last.Equal(info.ModTime()) {
+			changed = true
+		}
+		t.modified[file] = info.ModTime()
+	}
+	return changed
+}
+
+// Reload will (re)load the CA root certificates and the client certificate,
+// on error the current certificates are kept.
+func (t *TlsLoader) Reload() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.load()
+}
+
+func (t *TlsLoader) load() error {
+	var roots *x509.CertPool
+	var pair *tls.Certificate
+	var err error
+	if !t.options.InsecureSkipVerify {
+		if roots, err = newCertPool(t.options, t.logger); err != nil {
+			return err
+		}
+	}
+	if !t.options.NoClientAuth {
+		if pair, err = newKeyPair(t.options, t.logger); err != nil {
+			return err
+		}
+		if curr := t.Certificate(); curr != nil {
+			t.logger.Notice(fmt.Sprintf(
+				"reloaded client certificate '%s', serial %X expires %s (was serial %X expires %s)",
+				t.options.Crt,
+				pair.Leaf.SerialNumber,
+				pair.Leaf.NotAfter.Format(time.RFC3339),
+				curr.SerialNumber,
+				curr.NotAfter.Format(time.RFC3339),
+			))
+		}
+	}
+	t.roots.Store(roots)
+	t.pair.Store(pair)
+	t.changed()
+	return nil
+}
+
+// Watch will check the certificate files for changes on the given
+// interval and reloads them when modified until Close is called.
+func (t *TlsLoader) Watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+			t.lock.Lock()
+			if t.changed() {
+				t.logger.Debug("certificate files changed, reloading")
+				if err := t.load(); err != nil {
+					t.logger.Error(logf(logFields{"error": err.Error()}, "failed to reload certificates: %s", err.Error()))
+				}
+			}
+			t.lock.Unlock()
+		}
+	}
+}
+
+// Close will stop the watcher
+func (t *TlsLoader) Close() {
+	select {
+	case <-t.done:
+	default:
+		close(t.done)
+	}
+}
+
+// NewTlsLoader will load the certificates and create the tls config
+// used by the secure pools based on the given options.
+func NewTlsLoader(options *TlsOptions, logger *logger.Logger) (*TlsLoader, error) {
+	loader := &TlsLoader{
+		options:  options,
+		modified: make(map[string]time.Time),
+		done:     make(chan struct{}),
+		logger:   logger,
+	}
+	for _, pin := range options.Pins {
+		hash, err := ParsePin(pin)
+		if err != nil {
+			return nil, err
+		}
+		loader.pins = append(loader.pins, hash)
+	}
+	if len(loader.pins) > 0 {
+		logger.Debug(fmt.Sprintf("using %d public key pin(s) for verifying the remote", len(loader.pins)))
+	}
+	if err := loader.load(); err != nil {
+		return nil, err
+	}
+	// the verification is done by verifyConnection (see Config) so
+	// the root certificates can be swapped on a reload.
+	loader.config = &tls.Config{
+		MinVersion:         options.MinVersion,
+		CipherSuites:       options.CipherSuites,
+		InsecureSkipVerify: true,
+	}
+	if options.SessionCacheSize > 0 {
+		loader.config.ClientSessionCache = tls.NewLRUClientSessionCache(options.SessionCacheSize)
+	}
+	if options.InsecureSkipVerify {
+		logger.Alert("verification of the remote certificate is disabled, this should only be used for lab setups!")
+	}
+	if options.ServerName != "" {
+		logger.Debug(fmt.Sprintf("using server name '%s' for verifying the remote", options.ServerName))
+	}
+	if options.NoClientAuth {
+		logger.Debug("no client certificate will be presented to the remote")
+	} else {
+		loader.config.GetClientCertificate = loader.getClientCertificate
+	}
+	return loader, nil
+}
@@ -0,0 +1,269 @@
+package net
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pbergman/logger"
+)
+
+func newTestCertificate(t *testing.T) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	buf, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate
+}
+
+func TestParsePin(t *testing.T) {
+	hash := sha256.Sum256([]byte("test"))
+	pin := base64.StdEncoding.EncodeToString(hash[:])
+	for _, value := range []string{pin, "sha256/" + pin, "sha256//" + pin} {
+		if out, err := ParsePin(value); err != nil || string(out) != string(hash[:]) {
+			t.Fatalf("expected pin '%s' to decode, got %v", value, err)
+		}
+	}
+	for _, value := range []string{"", "foo", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := ParsePin(value); err == nil {
+			t.Fatalf("expected an error for pin '%s'", value)
+		}
+	}
+}
+
+func TestTlsLoader_verifyPins(t *testing.T) {
+	certificate := newTestCertificate(t)
+	hash := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+	other := sha256.Sum256([]byte("other"))
+	loader := new(TlsLoader)
+	if err := loader.verifyPins([]*x509.Certificate{certificate}); err != nil {
+		t.Fatalf("expected no error without pins got %s", err)
+	}
+	loader.pins = [][]byte{other[:], hash[:]}
+	if err := loader.verifyPins([]*x509.Certificate{certificate}); err != nil {
+		t.Fatalf("expected no error for matching pin got %s", err)
+	}
+	loader.pins = [][]byte{other[:]}
+	err := loader.verifyPins([]*x509.Certificate{certificate})
+	if !isFatal(err) {
+		t.Fatalf("expected a fatal pin error got %v", err)
+	}
+	var pin *PinError
+	if !errors.As(err, &pin) || pin.Hashes[0] != base64.StdEncoding.EncodeToString(hash[:]) {
+		t.Fatalf("expected the error to contain the hash of the remote got %v", err)
+	}
+}
+
+// writeTestCertificate creates a certificate for the given hosts signed by the
+// parent (self signed when nil) and writes the pem encoded certificate and key
+func writeTestCertificate(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, hosts ...string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: filepath.Base(name)},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, host)
+		}
+	}
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid, tmpl.KeyUsage = true, true, x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	buf, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name+".crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: buf}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name+".pem", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate, key
+}
+
+func TestCheckTls(t *testing.T) {
+	dir := t.TempDir()
+	root, rootKey := writeTestCertificate(t, filepath.Join(dir, "root"), nil, nil)
+	writeTestCertificate(t, filepath.Join(dir, "client"), root, rootKey)
+	writeTestCertificate(t, filepath.Join(dir, "other"), nil, nil)
+	log := logger.NewLogger("test")
+	check, err := CheckTls(&TlsOptions{
+		CA:  filepath.Join(dir, "root.crt"),
+		Crt: filepath.Join(dir, "client.crt"),
+		Pem: filepath.Join(dir, "client.pem"),
+	}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(check.Roots) != 1 || check.Certificate == nil || check.Certificate.Subject.CommonName != "client" {
+		t.Fatalf("expected the root and client certificate to be loaded got %+v", check)
+	}
+	for name, options := range map[string]*TlsOptions{
+		"other ca":    {CA: filepath.Join(dir, "other.crt"), Crt: filepath.Join(dir, "client.crt"), Pem: filepath.Join(dir, "client.pem")},
+		"other key":   {CA: filepath.Join(dir, "root.crt"), Crt: filepath.Join(dir, "client.crt"), Pem: filepath.Join(dir, "other.pem")},
+		"missing ca":  {CA: filepath.Join(dir, "missing.crt"), Crt: filepath.Join(dir, "client.crt"), Pem: filepath.Join(dir, "client.pem")},
+		"invalid pin": {CA: filepath.Join(dir, "root.crt"), NoClientAuth: true, Pins: []string{"foo"}},
+	} {
+		if _, err := CheckTls(options, log); err == nil {
+			t.Fatalf("expected an error for the %s", name)
+		}
+	}
+	if check, err := CheckTls(&TlsOptions{CA: filepath.Join(dir, "missing.crt"), NoClientAuth: true}, log); err != nil || len(check.Roots) != 0 || check.Certificate != nil {
+		t.Fatalf("expected the system roots to be used without client auth got %+v (%v)", check, err)
+	}
+}
+
+// serveTls starts a tls server with the given certificate (and the extra
+// certificates appended to its chain) and returns the address of the server
+func serveTls(t *testing.T, name string, extra ...string) string {
+	pair, err := tls.LoadX509KeyPair(name+".crt", name+".pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range extra {
+		certificates, err := readCertificates(file + ".crt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pair.Certificate = append(pair.Certificate, certificates[0].Raw)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{pair}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestTlsLoader_Config(t *testing.T) {
+	dir := t.TempDir()
+	root, rootKey := writeTestCertificate(t, filepath.Join(dir, "root"), nil, nil)
+	writeTestCertificate(t, filepath.Join(dir, "dns"), root, rootKey, "localhost")
+	writeTestCertificate(t, filepath.Join(dir, "ip"), root, rootKey, "127.0.0.1")
+	for name, expected := range map[string]struct {
+		server     string
+		serverName string
+		valid      bool
+	}{
+		"ip remote without ip san":         {"dns", "", false},
+		"ip remote with ip san":            {"ip", "", true},
+		"ip remote with server name":       {"dns", "localhost", true},
+		"ip remote with other server name": {"ip", "localhost", false},
+	} {
+		loader, err := NewTlsLoader(&TlsOptions{CA: filepath.Join(dir, "root.crt"), NoClientAuth: true, ServerName: expected.serverName}, logger.NewLogger("test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		address := serveTls(t, filepath.Join(dir, expected.server))
+		conn, err := new(Dialer).DialTls("tcp", address, loader.Config("127.0.0.1"))
+		if err == nil {
+			conn.Close()
+		}
+		if valid := err == nil; valid != expected.valid {
+			t.Fatalf("expected the %s to be valid: %t, got %v", name, expected.valid, err)
+		}
+	}
+}
+
+func TestTlsLoader_pins(t *testing.T) {
+	dir := t.TempDir()
+	root, rootKey := writeTestCertificate(t, filepath.Join(dir, "root"), nil, nil)
+	writeTestCertificate(t, filepath.Join(dir, "other"), nil, nil)
+	pinned, _ := writeTestCertificate(t, filepath.Join(dir, "pinned"), root, rootKey, "127.0.0.1")
+	writeTestCertificate(t, filepath.Join(dir, "attacker"), root, rootKey, "127.0.0.1")
+	pin := func(certificate *x509.Certificate) string {
+		hash := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+		return base64.StdEncoding.EncodeToString(hash[:])
+	}
+	for name, expected := range map[string]struct {
+		insecure bool
+		pin      string
+		server   string
+		extra    []string
+		valid    bool
+	}{
+		"pinned remote":                        {false, pin(pinned), "pinned", nil, true},
+		"pinned ca":                            {false, pin(root), "attacker", nil, true},
+		"pinned certificate appended":          {false, pin(pinned), "attacker", []string{"pinned"}, false},
+		"pinned ca appended to other chain":    {false, pin(root), "other", []string{"root"}, false},
+		"insecure pinned remote":               {true, pin(pinned), "pinned", nil, true},
+		"insecure pinned certificate appended": {true, pin(pinned), "attacker", []string{"pinned"}, false},
+	} {
+		loader, err := NewTlsLoader(&TlsOptions{
+			CA:                 filepath.Join(dir, "root.crt"),
+			NoClientAuth:       true,
+			InsecureSkipVerify: expected.insecure,
+			Pins:               []string{expected.pin},
+		}, logger.NewLogger("test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range expected.extra {
+			expected.extra[i] = filepath.Join(dir, expected.extra[i])
+		}
+		address := serveTls(t, filepath.Join(dir, expected.server), expected.extra...)
+		conn, err := new(Dialer).DialTls("tcp", address, loader.Config("127.0.0.1"))
+		if err == nil {
+			conn.Close()
+		}
+		if valid := err == nil; valid != expected.valid {
+			t.Fatalf("expected the %s to be valid: %t, got %v", name, expected.valid, err)
+		}
+	}
+}